@@ -7,10 +7,12 @@ import (
 	"bytes"
 	"debug/dwarf"
 	"debug/elf"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	demangle "github.com/ianlancetaylor/demangle"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -52,6 +54,8 @@ type address struct {
 // the PIE offset for a running instance.
 type BinFile struct {
 	pie     bool
+	interp  string
+	buildID string
 	funcs   map[string]uint64
 	inlined map[string][]InlinedFunc
 	// we use this map structure so that we can fuzzy match on the filename
@@ -59,19 +63,51 @@ type BinFile struct {
 	name  string
 }
 
-// FromPid creates a new BinFile from a running process.
+// FromPid creates a new BinFile from a running process. The executable is
+// read through /proc/pid/root so that processes in another mount namespace
+// (such as containers) are supported.
 func FromPid(pid int) (*BinFile, error) {
-	binpath, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	exe := fmt.Sprintf("/proc/%d/exe", pid)
+	binpath, err := os.Readlink(exe)
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.Open(binpath)
+	binpath = strings.TrimSuffix(binpath, " (deleted)")
+
+	b, err := FromPidFile(pid, binpath)
+	if err == nil {
+		return b, nil
+	}
+	// the file may have been deleted or replaced since the process started,
+	// but the kernel keeps a reference to the original
+	f, err := os.Open(exe)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 	return Read(f, filepath.Base(binpath))
 }
 
+// FromPidFile creates a new BinFile from a file as seen by a running process,
+// such as a shared library that it has loaded. Like FromPid, the file is read
+// through /proc/pid/root.
+func FromPidFile(pid int, path string) (*BinFile, error) {
+	name := filepath.Join(fmt.Sprintf("/proc/%d/root", pid), path)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The file may be a link (such as to the dynamic linker), in which case
+	// the target's name is the one that appears in the memory maps.
+	base := filepath.Base(path)
+	if target, err := os.Readlink(name); err == nil {
+		base = filepath.Base(target)
+	}
+	return Read(f, base)
+}
+
 // Read creates a new BinFile from an io.ReaderAt.
 func Read(r io.ReaderAt, name string) (*BinFile, error) {
 	f, err := elf.NewFile(r)
@@ -94,6 +130,18 @@ func Read(r io.ReaderAt, name string) (*BinFile, error) {
 		return nil, ErrInvalidElfType
 	}
 
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			interp, err := ioutil.ReadAll(p.Open())
+			if err == nil {
+				b.interp = string(bytes.TrimRight(interp, "\x00"))
+			}
+			break
+		}
+	}
+
+	b.buildID = readBuildID(f)
+
 	// Get the vaddr of the first loadable segment. I'm not sure if this is the
 	// right way to find the vaddr offset but it seems to work and I couldn't
 	// find any documentation about this.
@@ -116,14 +164,20 @@ func Read(r io.ReaderAt, name string) (*BinFile, error) {
 
 func (b *BinFile) buildFuncCache(f *elf.File, offset uint64) error {
 	symbols, err := f.Symbols()
-	if err != nil {
+	// Shared libraries are usually stripped of everything except the
+	// dynamic symbol table, which is needed for linking.
+	dynsyms, dynerr := f.DynamicSymbols()
+	if err != nil && dynerr != nil {
 		return err
 	}
 
 	b.funcs = make(map[string]uint64)
 
-	for _, s := range symbols {
-		if elf.ST_TYPE(s.Info) == elf.STT_FUNC {
+	for _, s := range append(symbols, dynsyms...) {
+		if elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Value == 0 {
+			continue
+		}
+		if _, ok := b.funcs[s.Name]; !ok {
 			b.funcs[s.Name] = s.Value - offset
 		}
 	}
@@ -297,6 +351,57 @@ func (b *BinFile) addLineCacheEntry(file string, line int, addr uint64) {
 	}
 }
 
+// Interp returns the path of the program interpreter (the dynamic linker)
+// requested by the executable, or an empty string if it is statically
+// linked.
+func (b *BinFile) Interp() string {
+	return b.interp
+}
+
+// BuildID returns the GNU build ID of the executable as a hex string, or an
+// empty string if it has none.
+func (b *BinFile) BuildID() string {
+	return b.buildID
+}
+
+// readBuildID finds the GNU build ID note in the note segments of an ELF
+// file.
+func readBuildID(f *elf.File) string {
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_NOTE {
+			continue
+		}
+		notes, err := ioutil.ReadAll(p.Open())
+		if err != nil {
+			continue
+		}
+		// each note is namesz, descsz and type followed by the name and
+		// the descriptor, both padded to 4 bytes
+		for len(notes) >= 12 {
+			namesz := f.ByteOrder.Uint32(notes[0:])
+			descsz := f.ByteOrder.Uint32(notes[4:])
+			typ := f.ByteOrder.Uint32(notes[8:])
+			name := 12 + align4(namesz)
+			end := name + align4(descsz)
+			if uint64(end) > uint64(len(notes)) {
+				break
+			}
+			if typ == ntGNUBuildID && string(notes[12:12+namesz]) == "GNU\x00" {
+				return hex.EncodeToString(notes[name : name+descsz])
+			}
+			notes = notes[end:]
+		}
+	}
+	return ""
+}
+
+// the type of the build ID note
+const ntGNUBuildID = 3
+
+func align4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
 // Pie returns true if this executable is position-independent.
 func (b *BinFile) Pie() bool {
 	return b.pie
@@ -442,3 +547,52 @@ func (b *BinFile) PieOffset(pid int) (uint64, error) {
 	}
 	return 0, errors.New("could not find pie offset")
 }
+
+// PCToFunc returns the name of the function that contains a PC, which is the
+// function with the highest start address that is not above it.
+func (b *BinFile) PCToFunc(pc uint64) (string, error) {
+	if b.funcs == nil {
+		return "", errors.New("no elf symbol table")
+	}
+
+	var name string
+	var start uint64
+	for fn, addr := range b.funcs {
+		if addr <= pc && (name == "" || addr > start || (addr == start && fn < name)) {
+			name, start = fn, addr
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("0x%x has no associated function", pc)
+	}
+	return name, nil
+}
+
+// PCToLine converts a PC to a file/line location. The location is the line
+// with the highest address that is not above the PC, so a PC in the middle of
+// a line is converted to that line.
+func (b *BinFile) PCToLine(pc uint64) (string, int, error) {
+	if b.lines == nil {
+		return "", 0, errors.New("no DWARF debugging data")
+	}
+
+	var file string
+	var line int
+	var best uint64
+	for l, addrs := range b.lines {
+		for _, fa := range addrs {
+			if fa.addr > pc {
+				continue
+			}
+			// prefer the lowest line when several start at the same PC
+			if file == "" || fa.addr > best ||
+				(fa.addr == best && (l < line || (l == line && fa.file < file))) {
+				file, line, best = fa.file, l, fa.addr
+			}
+		}
+	}
+	if file == "" {
+		return "", 0, fmt.Errorf("0x%x has no associated line", pc)
+	}
+	return file, line, nil
+}
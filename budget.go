@@ -0,0 +1,283 @@
+package perforator
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A Budget is a set of limits on the events of regions, used to detect
+// regressions. A budget is written in TOML with one key for each region and
+// event, whose value is a limit:
+//
+//	baseline = "before.json"
+//	sum.instructions = "<= 5.1e7"
+//	sum.branch-misses = 100
+//	sum.time-elapsed = "<= 2ms"
+//	sum.cache-misses = "<= +5%"
+//
+// A limit is a comparison (<=, <, >= or >) with a number, or only a number as
+// a shorthand for <=. A limit ending in % is relative to the value in the
+// baseline record. Regions whose names contain dots must be quoted.
+type Budget struct {
+	// Baseline is the path of the record that relative limits are
+	// compared with, if any.
+	Baseline string
+	Rules    []Rule
+}
+
+// A Rule is a limit on the value of an event for a region, which is the
+// mean over all invocations of the region.
+type Rule struct {
+	Region string
+	Label  string
+	Op     string
+	// Limit is the value that the event is compared with, or, if Relative
+	// is set, the allowed change from the baseline as a percentage.
+	Limit    float64
+	Relative bool
+}
+
+// ParseBudget reads a budget in TOML format.
+func ParseBudget(r io.Reader) (*Budget, error) {
+	var v map[string]interface{}
+	md, err := toml.DecodeReader(r, &v)
+	if err != nil {
+		return nil, fmt.Errorf("budget: %w", err)
+	}
+
+	b := &Budget{}
+	for _, key := range md.Keys() {
+		switch {
+		case len(key) == 1 && key[0] == "baseline":
+			path, ok := v["baseline"].(string)
+			if !ok {
+				return nil, fmt.Errorf("budget: baseline must be a path")
+			}
+			b.Baseline = path
+		case len(key) == 1:
+			if _, ok := v[key[0]].(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("budget: %s: expected a table of limits", key[0])
+			}
+		case len(key) == 2:
+			region := v[key[0]].(map[string]interface{})
+			rule, err := ParseRule(key[0], key[1], region[key[1]])
+			if err != nil {
+				return nil, fmt.Errorf("budget: %w", err)
+			}
+			b.Rules = append(b.Rules, rule)
+		default:
+			return nil, fmt.Errorf("budget: %s: too many levels of nesting", key)
+		}
+	}
+	return b, nil
+}
+
+// ParseRule parses the limit on the event 'label' of a region. The limit may
+// be a string or a number (see Budget). An alias such as "cycles" limits the
+// event that it names.
+func ParseRule(region, label string, limit interface{}) (Rule, error) {
+	r := Rule{
+		Region: region,
+		Label:  eventLabel(label),
+		Op:     "<=",
+	}
+	switch l := limit.(type) {
+	case int64:
+		r.Limit = float64(l)
+		return r, nil
+	case float64:
+		r.Limit = l
+		return r, nil
+	case string:
+		s := strings.TrimSpace(l)
+		for _, op := range []string{"<=", ">=", "<", ">"} {
+			if strings.HasPrefix(s, op) {
+				r.Op = op
+				s = strings.TrimSpace(s[len(op):])
+				break
+			}
+		}
+		if strings.HasSuffix(s, "%") {
+			r.Relative = true
+			s = strings.TrimSuffix(s, "%")
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil && !r.Relative && label == "time-elapsed" {
+			var d time.Duration
+			d, err = time.ParseDuration(s)
+			v = float64(d)
+		}
+		if err != nil {
+			return r, fmt.Errorf("%s.%s: invalid limit %q", region, label, l)
+		}
+		r.Limit = v
+		return r, nil
+	}
+	return r, fmt.Errorf("%s.%s: limit must be a number or a string", region, label)
+}
+
+func (r Rule) String() string {
+	if r.Relative {
+		return fmt.Sprintf("%s %+g%%", r.Op, r.Limit)
+	}
+	return fmt.Sprintf("%s %s", r.Op, formatStat(r.Label, r.Limit))
+}
+
+// A RuleResult is the outcome of checking a rule.
+type RuleResult struct {
+	Rule
+	// Value is the measured value and Baseline is the value in the
+	// baseline for relative rules. Bound is the limit that Value was
+	// compared with.
+	Value    float64
+	Baseline float64
+	Bound    float64
+	Pass     bool
+	// Err explains why the rule could not be checked, in which case it
+	// fails.
+	Err string
+}
+
+// BudgetReport is the result of checking every rule of a budget.
+type BudgetReport []RuleResult
+
+// Requires returns what must be measured to check the budget, given the
+// derived metrics 'formulas' that are already computed: the built-in metrics
+// that rules refer to by name, and the events limited by the other rules.
+func (b *Budget) Requires(formulas []*Formula) (metrics []*Formula, events []string) {
+	have := make(map[string]bool)
+	for _, f := range formulas {
+		have[f.Name] = true
+	}
+	for _, r := range b.Rules {
+		if r.Label == "time-elapsed" || have[r.Label] {
+			continue
+		}
+		have[r.Label] = true
+		if f, err := ParseFormula(r.Label); err == nil {
+			metrics = append(metrics, f)
+		} else {
+			events = append(events, r.Label)
+		}
+	}
+	return metrics, events
+}
+
+// Check evaluates every rule against the metrics of a run. The baseline is
+// only used by relative rules.
+func (b *Budget) Check(total, baseline TotalMetrics) BudgetReport {
+	find := func(regions []*regionSamples, r Rule) ([]float64, string) {
+		for _, s := range regions {
+			if s.name != r.Region {
+				continue
+			}
+			vals, ok := s.values[r.Label]
+			if !ok {
+				return nil, "event not measured"
+			}
+			if len(vals) == 0 {
+				return nil, "no value"
+			}
+			return vals, ""
+		}
+		return nil, "region not executed"
+	}
+
+	samples := total.samples()
+	base := baseline.samples()
+	report := make(BudgetReport, 0, len(b.Rules))
+	for _, r := range b.Rules {
+		res := RuleResult{
+			Rule:     r,
+			Value:    math.NaN(),
+			Baseline: math.NaN(),
+			Bound:    r.Limit,
+		}
+		vals, msg := find(samples, r)
+		if msg != "" {
+			res.Err = msg
+			report = append(report, res)
+			continue
+		}
+		res.Value = mean(vals)
+
+		if r.Relative {
+			if baseline == nil {
+				res.Err = "no baseline"
+				report = append(report, res)
+				continue
+			}
+			bvals, msg := find(base, r)
+			if msg != "" {
+				res.Err = "baseline: " + msg
+				report = append(report, res)
+				continue
+			}
+			res.Baseline = mean(bvals)
+			res.Bound = res.Baseline + math.Abs(res.Baseline)*r.Limit/100
+		}
+
+		switch r.Op {
+		case "<=":
+			res.Pass = res.Value <= res.Bound
+		case "<":
+			res.Pass = res.Value < res.Bound
+		case ">=":
+			res.Pass = res.Value >= res.Bound
+		case ">":
+			res.Pass = res.Value > res.Bound
+		}
+		report = append(report, res)
+	}
+	return report
+}
+
+// Passed returns true if every rule passed.
+func (br BudgetReport) Passed() bool {
+	for _, r := range br {
+		if !r.Pass {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo pretty-prints the report and writes the result to a MetricsWriter,
+// with one row for each rule.
+func (br BudgetReport) WriteTo(table MetricsWriter) {
+	table.SetHeader([]string{"region", "event", "value", "limit", "baseline", "result"})
+
+	format := func(label string, v float64) string {
+		if math.IsNaN(v) {
+			return ""
+		}
+		return formatStat(label, v)
+	}
+	for _, r := range br {
+		result := "PASS"
+		if r.Err != "" {
+			result = "FAIL (" + r.Err + ")"
+		} else if !r.Pass {
+			result = "FAIL"
+		}
+		limit := r.Rule.String()
+		if r.Relative && !math.IsNaN(r.Baseline) {
+			limit = fmt.Sprintf("%s (%s %s)", limit, r.Op, format(r.Label, r.Bound))
+		}
+		table.Append([]string{
+			r.Region,
+			r.Label,
+			format(r.Label, r.Value),
+			limit,
+			format(r.Label, r.Baseline),
+			result,
+		})
+	}
+	table.Render()
+}
@@ -0,0 +1,103 @@
+package perforator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	b, err := ParseBudget(strings.NewReader(`
+baseline = "base.json"
+sum.instructions = "<= 5.1e7"
+sum.branch-misses = 100
+sum.time-elapsed = "< 2ms"
+sum.cache-misses = "<= +5%"
+
+["main.c:10-main.c:20"]
+instructions = ">= 10"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Baseline != "base.json" || len(b.Rules) != 5 {
+		t.Fatalf("unexpected budget: %+v", b)
+	}
+	want := []Rule{
+		{"sum", "instructions", "<=", 5.1e7, false},
+		{"sum", "branch-misses", "<=", 100, false},
+		{"sum", "time-elapsed", "<", float64(2 * time.Millisecond), false},
+		{"sum", "cache-misses", "<=", 5, true},
+		{"main.c:10-main.c:20", "instructions", ">=", 10, false},
+	}
+	for i, w := range want {
+		if b.Rules[i] != w {
+			t.Errorf("rule %d: got %+v, want %+v", i, b.Rules[i], w)
+		}
+	}
+
+	// aliases refer to the labels of their events
+	if r, err := ParseRule("sum", "cycles", int64(10)); err != nil || r.Label != "cpu-cycles" {
+		t.Errorf("got rule %+v (%v), want a limit on cpu-cycles", r, err)
+	}
+
+	first := named("sum", time.Millisecond, count("instructions", 5e7), count("branch-misses", 90), count("cache-misses", 100))
+	second := named("sum", time.Millisecond, count("instructions", 5e7), count("branch-misses", 130), count("cache-misses", 120))
+	total := TotalMetrics{first, second}
+	baseline := TotalMetrics{first}
+
+	report := b.Check(total, baseline)
+	pass := []bool{true, false, true, false, false}
+	for i, p := range pass {
+		if report[i].Pass != p {
+			t.Errorf("rule %d: got pass=%v, want %v: %+v", i, report[i].Pass, p, report[i])
+		}
+	}
+	if r := report[3]; r.Value != 110 || r.Baseline != 100 || r.Bound != 105 {
+		t.Errorf("unexpected relative result: %+v", r)
+	}
+	if report[4].Err != "region not executed" {
+		t.Errorf("expected a missing region, got %+v", report[4])
+	}
+	if report.Passed() {
+		t.Error("expected the budget to be exceeded")
+	}
+
+	if report := b.Check(total, nil); report[3].Err != "no baseline" {
+		t.Errorf("expected no baseline, got %+v", report[3])
+	}
+
+	for _, bad := range []string{`sum.instructions = "<= lots"`, `sum.instructions = true`, `a.b.c = 1`} {
+		if _, err := ParseBudget(strings.NewReader(bad)); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestBudgetMetrics(t *testing.T) {
+	b, err := ParseBudget(strings.NewReader(`
+sum.ipc = ">= 1.5"
+sum.cycles = 100
+sum.time-elapsed = "1ms"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a built-in metric is computed rather than measured as an event
+	metrics, events := b.Requires(nil)
+	if len(metrics) != 1 || metrics[0].Name != "ipc" || !reflect.DeepEqual(events, []string{"cpu-cycles"}) {
+		t.Fatalf("got metrics %v and events %v, want ipc and cpu-cycles", metrics, events)
+	}
+	if again, _ := b.Requires(metrics); len(again) != 0 {
+		t.Errorf("got metrics %v, want none when ipc is already computed", again)
+	}
+
+	total := TotalMetrics{named("sum", time.Millisecond, count("instructions", 200), count("cpu-cycles", 100))}
+	total[0].Metrics = total[0].derive(metrics)
+	for _, r := range b.Check(total, nil) {
+		if !r.Pass || r.Err != "" {
+			t.Errorf("rule %v: got %+v, want a pass", r.Rule, r)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/zyedidia/perforator"
+)
+
+// check profiles a command and checks the results against a budget, exiting
+// with status 1 if any limit is exceeded.
+func check(argv []string) {
+	flagparser := flags.NewParser(&opts, flags.PassDoubleDash|flags.PrintErrors)
+	flagparser.Usage = "check --budget FILE [OPTIONS] COMMAND [ARGS]"
+	_, err := flagparser.AddGroup("Check Options", "", &checkOpts)
+	must("flags", err)
+	args, err := flagparser.ParseArgs(argv)
+	if err != nil {
+		os.Exit(1)
+	}
+	loadConfig(flagparser)
+	setup()
+
+	if len(args) <= 0 || opts.Help {
+		flagparser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if opts.Pid != 0 {
+		fatal("error: cannot check a budget when attaching with --pid")
+	}
+
+	f, err := os.Open(checkOpts.Budget)
+	must("open-budget", err)
+	budget, err := perforator.ParseBudget(f)
+	f.Close()
+	must("read-budget", err)
+
+	// the regions, events and metrics that the budget limits are measured as
+	// well
+	var formulas []*perforator.Formula
+	for _, spec := range opts.Metrics {
+		f, err := perforator.ParseFormula(spec)
+		must("metric-parse", err)
+		formulas = append(formulas, f)
+	}
+	metrics, events := budget.Requires(formulas)
+	for _, f := range metrics {
+		opts.Metrics = append(opts.Metrics, f.Name)
+	}
+	for _, r := range budget.Rules {
+		if !contains(opts.Regions, r.Region) {
+			opts.Regions = append(opts.Regions, r.Region)
+		}
+	}
+	cfg := config(args)
+	must("budget-events", cfg.Events.Add(events...))
+	var rep perforator.Reporter = &diagnostics{
+		seen: make(map[string]bool),
+	}
+	rep, done := outputs(rep, opts.TraceOut, opts.PprofOut, opts.RangeInnerDelimiter)
+	cfg.Reporter = rep
+
+	// a baseline in the budget is relative to the budget file
+	var baseline perforator.TotalMetrics
+	path := checkOpts.Baseline
+	if path == "" && budget.Baseline != "" {
+		path = budget.Baseline
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(checkOpts.Budget), path)
+		}
+	}
+	if path != "" {
+		baseline = readRecord(path, opts.Metrics).Total()
+	}
+
+	out := output(opts.Output)
+	defer out.Close()
+
+	total, err := profile(cfg)
+	done()
+	if err != nil {
+		out.Close()
+		fatal(err)
+	}
+	report := budget.Check(total, baseline)
+
+	var mw perforator.MetricsWriter = perforator.NewTableWriter(out)
+	if opts.Csv {
+		mw = perforator.NewCSVWriter(out)
+	}
+	report.WriteTo(mw)
+
+	if !report.Passed() {
+		out.Close()
+		fatal("check: budget exceeded")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
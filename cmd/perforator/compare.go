@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/zyedidia/perforator"
+)
+
+// compare profiles two programs several times each and tests the
+// differences between them for significance.
+func compare(argv []string) {
+	flagparser := flags.NewParser(&opts, flags.PassDoubleDash|flags.PrintErrors)
+	flagparser.Usage = "compare [OPTIONS] OLD NEW [ARGS]"
+	_, err := flagparser.AddGroup("Compare Options", "", &compareOpts)
+	must("flags", err)
+	args, err := flagparser.ParseArgs(argv)
+	if err != nil {
+		os.Exit(1)
+	}
+	loadConfig(flagparser)
+	setup()
+
+	if len(args) < 2 || opts.Help {
+		flagparser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if opts.Pid != 0 {
+		fatal("error: cannot compare when attaching with --pid")
+	}
+	if opts.TraceOut != "" || opts.PprofOut != "" {
+		fatal("error: --trace-out and --pprof-out cannot be used with compare")
+	}
+	// a single run of each program says nothing about significance
+	if flagparser.FindOptionByLongName("repeat").IsSetDefault() {
+		opts.Repeat = 10
+	}
+	if opts.Repeat < 2 {
+		fatal("error: compare needs at least 2 runs of each program")
+	}
+
+	out := output(opts.Output)
+	defer out.Close()
+
+	// both programs are given the same arguments
+	cfg := config(append([]string{args[0]}, args[2:]...))
+	cfg.Repeat = 1
+	cfg.Reporter = &diagnostics{
+		seen: make(map[string]bool),
+	}
+
+	// the runs alternate so that changes in the load of the machine affect
+	// both programs alike
+	run := func(target string, i int) perforator.TotalMetrics {
+		cfg.Target = target
+		total, err := profile(cfg)
+		if err != nil {
+			out.Close()
+			fatal(err)
+		}
+		// each session is one run of the comparison
+		for j := range total {
+			total[j].Run = i
+		}
+		return total
+	}
+	var old, new perforator.TotalMetrics
+	for i := 0; i < opts.Repeat; i++ {
+		old = append(old, run(args[0], i)...)
+		new = append(new, run(args[1], i)...)
+	}
+
+	writeDiff(perforator.Diff(old, new), compareOpts.Alpha, out, opts.Csv)
+}
+
+// diagnostics is a Reporter that only writes diagnostics, each one once.
+type diagnostics struct {
+	perforator.BaseReporter
+	seen map[string]bool
+}
+
+func (d *diagnostics) Diagnostic(msg string) {
+	if !d.seen[msg] {
+		d.seen[msg] = true
+		fmt.Fprintln(os.Stderr, "perforator:", msg)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jessevdk/go-flags"
+)
+
+// A configFile holds the options read from a configuration file given with
+// --config. It is written in TOML:
+//
+//	events = ["instructions", "cache-misses"]
+//	groups = [["cpu-cycles", "instructions"]]
+//	kernel = true
+//	format = "csv"
+//	sort-key = "instructions"
+//
+//	[regions]
+//	hot = "bench.c:18-bench.c:23"
+//	compute = "compute"
+//
+// Each entry in the regions table is a region that is profiled and reported
+// with the entry's name. Options given on the command line override the
+// ones in the file, and regions given with --region may refer to the names
+// in the file.
+type configFile struct {
+	Events      interface{}   `toml:"events"`
+	Groups      []interface{} `toml:"groups"`
+	Metrics     []string      `toml:"metrics"`
+	Kernel      *bool         `toml:"kernel"`
+	Hypervisor  *bool         `toml:"hypervisor"`
+	ExcludeUser *bool         `toml:"exclude-user"`
+	Format      *string       `toml:"format"`
+	SortKey     *string       `toml:"sort-key"`
+	ReverseSort *bool         `toml:"reverse-sort"`
+
+	Regions map[string]string `toml:"regions"`
+	// the names of the regions in the order they are written
+	names []string
+}
+
+// readConfigFile reads a configuration file in TOML format.
+func readConfigFile(r io.Reader) (*configFile, error) {
+	var cf configFile
+	md, err := toml.DecodeReader(r, &cf)
+	if err != nil {
+		return nil, err
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return nil, fmt.Errorf("unknown option %s", keys[0])
+	}
+	for _, key := range md.Keys() {
+		if len(key) == 2 && key[0] == "regions" {
+			cf.names = append(cf.names, key[1])
+		}
+	}
+	if cf.Format != nil && *cf.Format != "table" && *cf.Format != "csv" {
+		return nil, fmt.Errorf("format must be table or csv, not %q", *cf.Format)
+	}
+	return &cf, nil
+}
+
+// eventList returns a list of events written either as a comma-separated
+// string or as an array of strings.
+func eventList(v interface{}) (string, error) {
+	switch l := v.(type) {
+	case string:
+		return l, nil
+	case []interface{}:
+		evs := make([]string, 0, len(l))
+		for _, ev := range l {
+			s, ok := ev.(string)
+			if !ok {
+				return "", fmt.Errorf("invalid event %v", ev)
+			}
+			evs = append(evs, s)
+		}
+		return strings.Join(evs, ","), nil
+	}
+	return "", fmt.Errorf("invalid event list %v", v)
+}
+
+// regionSpecs maps the names of regions in the configuration file to the
+// regions themselves.
+var regionSpecs = make(map[string]string)
+
+// loadConfig reads the configuration file given with --config, if any, and
+// sets the options that were not given on the command line.
+func loadConfig(parser *flags.Parser) {
+	if opts.Config == "" {
+		return
+	}
+	f, err := os.Open(opts.Config)
+	must("open-config", err)
+	cf, err := readConfigFile(f)
+	f.Close()
+	must("config", err)
+
+	unset := func(name string) bool {
+		return parser.FindOptionByLongName(name).IsSetDefault()
+	}
+	if cf.Events != nil && unset("events") {
+		opts.Events, err = eventList(cf.Events)
+		must("config", err)
+	}
+	if cf.Groups != nil && unset("group") {
+		opts.GroupEvents = nil
+		for _, g := range cf.Groups {
+			evs, err := eventList(g)
+			must("config", err)
+			opts.GroupEvents = append(opts.GroupEvents, evs)
+		}
+	}
+	if cf.Metrics != nil && unset("metric") {
+		opts.Metrics = cf.Metrics
+	}
+	if cf.Kernel != nil && unset("kernel") {
+		opts.Kernel = *cf.Kernel
+	}
+	if cf.Hypervisor != nil && unset("hypervisor") {
+		opts.Hypervisor = *cf.Hypervisor
+	}
+	if cf.ExcludeUser != nil && unset("exclude-user") {
+		opts.ExcludeUser = *cf.ExcludeUser
+	}
+	if cf.Format != nil && unset("csv") {
+		opts.Csv = *cf.Format == "csv"
+	}
+	if cf.SortKey != nil && unset("sort-key") {
+		opts.SortKey = *cf.SortKey
+	}
+	if cf.ReverseSort != nil && unset("reverse-sort") {
+		opts.ReverseSort = *cf.ReverseSort
+	}
+
+	for name, spec := range cf.Regions {
+		regionSpecs[name] = spec
+	}
+	if unset("region") {
+		opts.Regions = cf.names
+	}
+}
@@ -1,38 +1,90 @@
 package main
 
 import (
-	"strings"
+	"time"
 
 	"github.com/zyedidia/perf"
 	"github.com/zyedidia/perforator"
 )
 
 var opts struct {
-	List                 string   `short:"l" long:"list" description:"List available events for {hardware, software, cache, trace} event types"`
-	Events               string   `short:"e" long:"events" default-mask:"-" default:"instructions,branch-instructions,branch-misses,cache-references,cache-misses" description:"Comma-separated list of events to profile"`
-	GroupEvents          []string `short:"g" long:"group" description:"Comma-separated list of events to profile together as a group"`
-	Regions              []string `short:"r" long:"region" description:"Region(s) to profile: 'function' or 'start-end'; start/end locations may be file:line or hex addresses"`
-	Kernel               bool     `long:"kernel" description:"Include kernel code in measurements"`
-	Hypervisor           bool     `long:"hypervisor" description:"Include hypervisor code in measurements"`
-	ExcludeUser          bool     `long:"exclude-user" description:"Exclude user code from measurements"`
-	IgnoreMissingRegions bool     `long:"ignore-missing-regions" description:"Continues execution even if a region is missing"`
-	Summary              bool     `short:"s" long:"summary" description:"Instead of printing results immediately, show an aggregated summary afterwards"`
-	SortKey              string   `long:"sort-key" description:"Key to sort summary tables with"`
-	ReverseSort          bool     `long:"reverse-sort" description:"Reverse summary table sorting"`
-	NoSort               bool     `long:"no-sort" description:"Don't sort the summary table"`
-	Csv                  bool     `long:"csv" description:"Write summary output in CSV format"`
-	Output               string   `short:"o" long:"output" description:"Write summary output to file"`
-	Verbose              bool     `short:"V" long:"verbose" description:"Show verbose debug information"`
-	Version              bool     `short:"v" long:"version" description:"Show version information"`
-	Help                 bool     `short:"h" long:"help" description:"Show this help message"`
-	RangeInnerDelimiter  string   `long:"range-inner-delim" default:"-" description:"Set range inner delimiter"`
-	ExcludeClones        bool     `long:"exclude-clones" description:"Exclude clone functions in case of range is a function name"`
+	Config               string        `short:"c" long:"config" description:"Read regions, events and other options from a TOML file; options on the command line override the file"`
+	List                 string        `short:"l" long:"list" description:"List available events for {hardware, software, cache, pmu, trace} event types or {all} of them, or the built-in {metrics}"`
+	Json                 bool          `long:"json" description:"With --list, print the type, config and description of every event as JSON"`
+	Events               string        `short:"e" long:"events" default-mask:"-" default:"instructions,branch-instructions,branch-misses,cache-references,cache-misses" description:"Comma-separated list of events to profile"`
+	Metrics              []string      `short:"m" long:"metric" description:"Derived metric to compute: 'name=expr' (e.g. 'ipc=instructions/cpu-cycles') or a built-in metric"`
+	GroupEvents          []string      `short:"g" long:"group" description:"Comma-separated list of events to profile together as a group"`
+	Regions              []string      `short:"r" long:"region" description:"Region(s) to profile: 'function' or 'start-end'; start/end locations may be file:line or hex addresses"`
+	Pid                  int           `short:"p" long:"pid" description:"Attach to an already running process instead of starting COMMAND; detaches on Ctrl-C"`
+	Timeout              time.Duration `long:"timeout" description:"Stop tracing and detach from the target after the given duration (e.g. 30s)"`
+	Recursion            string        `long:"recursion" choice:"outer" choice:"all" default:"outer" description:"Report only the outermost invocation of a recursive region, or all invocations"`
+	Counters             string        `long:"counters" choice:"region" choice:"always" default:"region" description:"Run the counters of a thread only while it is in a region, or always and measure regions with snapshots"`
+	Scope                string        `long:"scope" choice:"thread" choice:"process" default:"thread" description:"Count only the thread that enters a region, or every thread and child process of the target"`
+	FollowExec           bool          `long:"follow-exec" description:"Keep tracing after the target executes another program, and find the regions in the new program"`
+	Binary               string        `long:"binary" description:"With --follow-exec, only find regions in programs with this name or path"`
+	Kernel               bool          `long:"kernel" description:"Include kernel code in measurements"`
+	Hypervisor           bool          `long:"hypervisor" description:"Include hypervisor code in measurements"`
+	ExcludeUser          bool          `long:"exclude-user" description:"Exclude user code from measurements"`
+	IgnoreMissingRegions bool          `long:"ignore-missing-regions" description:"Continues execution even if a region is missing"`
+	Summary              bool          `short:"s" long:"summary" description:"Instead of printing results immediately, show an aggregated summary afterwards"`
+	NoMultiplex          bool          `long:"no-multiplex" description:"Run the command once for each set of events that fits in the hardware counters, so that no event is multiplexed"`
+	Repeat               int           `short:"n" long:"repeat" default:"1" description:"Run the command N times and show statistics for each region and event"`
+	GroupBy              string        `long:"group-by" choice:"region" choice:"thread" choice:"process" description:"Aggregate the summary by region, thread or process (implies --summary)"`
+	Tree                 bool          `long:"tree" description:"Show the nesting tree of regions with inclusive and exclusive counts (implies --summary)"`
+	SortKey              string        `long:"sort-key" description:"Key to sort summary tables with"`
+	ReverseSort          bool          `long:"reverse-sort" description:"Reverse summary table sorting"`
+	NoSort               bool          `long:"no-sort" description:"Don't sort the summary table"`
+	Csv                  bool          `long:"csv" description:"Write summary output in CSV format"`
+	ShowScaling          bool          `long:"show-scaling" description:"Show the factor that each event was scaled by to account for multiplexing"`
+	MinRunning           float64       `long:"min-running" default:"0.5" description:"Mark values of events that were running for less than this fraction of the time they were enabled as unreliable with '?' (0 to disable)"`
+	TraceOut             string        `long:"trace-out" description:"Write a timeline of the invocations of regions to file in Chrome Trace Event Format, for Perfetto or chrome://tracing"`
+	PprofOut             string        `long:"pprof-out" description:"Write the nesting tree of regions to file as a gzip-compressed pprof profile, for 'go tool pprof'"`
+	Output               string        `short:"o" long:"output" description:"Write summary output to file, or the record file for 'perforator record' (default perforator.json; a .jsonl extension writes JSON Lines)"`
+	Verbose              bool          `short:"V" long:"verbose" description:"Show verbose debug information"`
+	Version              bool          `short:"v" long:"version" description:"Show version information"`
+	Help                 bool          `short:"h" long:"help" description:"Show this help message"`
+	RangeInnerDelimiter  string        `long:"range-inner-delim" default:"-" description:"Set range inner delimiter"`
+	ExcludeClones        bool          `long:"exclude-clones" description:"Exclude clone functions in case of range is a function name"`
+}
+
+var reportOpts struct {
+	Metrics     []string `short:"m" long:"metric" description:"Derived metric to compute from the recorded events, in addition to the recorded metrics"`
+	Summary     bool     `short:"s" long:"summary" description:"Show an aggregated summary instead of each invocation"`
+	GroupBy     string   `long:"group-by" choice:"region" choice:"thread" choice:"process" description:"Aggregate the summary by region, thread or process (implies --summary)"`
+	Tree        bool     `long:"tree" description:"Show the nesting tree of regions with inclusive and exclusive counts (implies --summary)"`
+	SortKey     string   `long:"sort-key" description:"Key to sort summary tables with"`
+	ReverseSort bool     `long:"reverse-sort" description:"Reverse summary table sorting"`
+	NoSort      bool     `long:"no-sort" description:"Don't sort the summary table"`
+	Csv         bool     `long:"csv" description:"Write output in CSV format"`
+	ShowScaling bool     `long:"show-scaling" description:"Show the factor that each event was scaled by to account for multiplexing"`
+	MinRunning  float64  `long:"min-running" default:"0.5" description:"Mark values of events that were running for less than this fraction of the time they were enabled as unreliable with '?' (0 to disable)"`
+	TraceOut    string   `long:"trace-out" description:"Write a timeline of the invocations of regions to file in Chrome Trace Event Format"`
+	PprofOut    string   `long:"pprof-out" description:"Write the nesting tree of regions to file as a gzip-compressed pprof profile"`
+	Output      string   `short:"o" long:"output" description:"Write output to file"`
+	Help        bool     `short:"h" long:"help" description:"Show this help message"`
+}
+
+var diffOpts struct {
+	Metrics []string `short:"m" long:"metric" description:"Derived metric to compute from the recorded events, in addition to the recorded metrics"`
+	Alpha   float64  `long:"alpha" default:"0.05" description:"Significance level: changes with a higher p-value are marked with '~'"`
+	Csv     bool     `long:"csv" description:"Write output in CSV format"`
+	Output  string   `short:"o" long:"output" description:"Write output to file"`
+	Help    bool     `short:"h" long:"help" description:"Show this help message"`
+}
+
+var compareOpts struct {
+	Alpha float64 `long:"alpha" default:"0.05" description:"Significance level: changes with a higher p-value are marked with '~'"`
+}
+
+var checkOpts struct {
+	Budget   string `long:"budget" required:"true" description:"TOML file with the limits on each region and event"`
+	Baseline string `long:"baseline" description:"Record to compare relative limits with, instead of the baseline given in the budget"`
 }
 
 // ParseEventList looks at a comma-separated list of events and returns the
 // perf Configurators corresponding to those events.
 func ParseEventList(s string) ([]perf.Configurator, error) {
-	parts := strings.Split(s, ",")
+	parts := splitEvents(s)
 	var configs []perf.Configurator
 	var errs []error
 	for _, ev := range parts {
@@ -46,3 +98,23 @@ func ParseEventList(s string) ([]perf.Configurator, error) {
 
 	return configs, perforator.MultiErr(errs)
 }
+
+// splitEvents splits a comma-separated list of events. Commas between the
+// slashes of a PMU event such as cpu/event=0x3c,umask=0x00/ separate its
+// terms instead.
+func splitEvents(s string) []string {
+	var parts []string
+	start, slashes := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '/':
+			slashes++
+		case ',':
+			if slashes%2 == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/zyedidia/perf"
+	"github.com/zyedidia/perforator"
+)
+
+// profilePasses splits the events into passes that fit in the counters, runs
+// a session for each pass and merges their results, which are then sent to
+// the reporter of 'cfg' as if they came from a single session. If a pass
+// times out, the passes run until then are merged and returned with the
+// error.
+func profilePasses(cfg perforator.Config) (perforator.TotalMetrics, error) {
+	passes, err := cfg.Events.Passes(func(c []perf.Configurator) bool {
+		return perforator.CountTogether(c, cfg.Options)
+	})
+	must("no-multiplex", err)
+	if len(passes) == 1 {
+		return profileOnce(cfg)
+	}
+	if cfg.Pid != 0 {
+		fatal("error: --no-multiplex needs", len(passes), "runs, which is not possible when attaching with --pid")
+	}
+
+	diag := &diagnostics{
+		seen: make(map[string]bool),
+	}
+	var recs []*perforator.Record
+	for i, pass := range passes {
+		if opts.Verbose {
+			fmt.Printf("INFO: pass %d/%d: %v\n", i+1, len(passes), pass.Labels())
+		}
+		recorder := perforator.NewRecordReporter(ioutil.Discard, false)
+		c := cfg
+		c.Events = pass
+		// each diagnostic is written only once over all passes
+		c.Reporter = perforator.MultiReporter(diag, recorder)
+		_, err = profileOnce(c)
+		recs = append(recs, recorder.Record())
+		if err != nil {
+			break
+		}
+	}
+
+	rec, dropped := perforator.MergeRecords(recs, cfg.Events.Labels())
+	if dropped > 0 {
+		diag.Diagnostic(fmt.Sprintf("%d invocations did not happen in every pass and were left out", dropped))
+	}
+	if cfg.Reporter != nil {
+		rec.Replay(cfg.Reporter)
+	}
+	return rec.Total(), err
+}
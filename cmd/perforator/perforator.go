@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"runtime"
+	"os/signal"
+	"path/filepath"
 
-	"github.com/zyedidia/perf"
 	"github.com/jessevdk/go-flags"
+	"github.com/zyedidia/perf"
 	"github.com/zyedidia/perforator"
 	"github.com/zyedidia/perforator/utrace"
+	"golang.org/x/sys/unix"
 )
 
 func fatal(a ...interface{}) {
@@ -25,23 +29,169 @@ func must(desc string, err error) {
 	}
 }
 
-func metricsWriter(w io.Writer) perforator.MetricsWriter {
-	if opts.Csv {
-		return perforator.NewCSVWriter(w)
+func reporter(w io.Writer, csv bool, ropts perforator.ReportOptions) perforator.Reporter {
+	if csv {
+		return perforator.NewCSVReporter(w, ropts)
 	}
-	return perforator.NewTableWriter(w)
+	return perforator.NewTableReporter(w, ropts)
 }
 
 func main() {
-	runtime.LockOSThread()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "record":
+			run(os.Args[2:], true)
+			return
+		case "report":
+			report(os.Args[2:])
+			return
+		case "diff":
+			diff(os.Args[2:])
+			return
+		case "compare":
+			compare(os.Args[2:])
+			return
+		case "check":
+			check(os.Args[2:])
+			return
+		}
+	}
+	run(os.Args[1:], false)
+}
 
+// run profiles a command. If 'record' is set the results are written to a
+// record file instead of being shown.
+func run(argv []string, record bool) {
 	flagparser := flags.NewParser(&opts, flags.PassDoubleDash|flags.PrintErrors)
-	flagparser.Usage = "[OPTIONS] COMMAND [ARGS]"
-	args, err := flagparser.Parse()
+	flagparser.Usage = fmt.Sprintf("[OPTIONS] COMMAND [ARGS]\n  %[1]s record [OPTIONS] COMMAND [ARGS]\n  %[1]s report [OPTIONS] FILE\n  %[1]s diff [OPTIONS] OLD NEW\n  %[1]s compare [OPTIONS] OLD NEW [ARGS]\n  %[1]s check --budget FILE [OPTIONS] COMMAND [ARGS]", flagparser.Name)
+	if record {
+		flagparser.Usage = "record [OPTIONS] COMMAND [ARGS]"
+	}
+	args, err := flagparser.ParseArgs(argv)
 	if err != nil {
 		os.Exit(1)
 	}
+	loadConfig(flagparser)
+	setup()
+
+	if (len(args) <= 0 && opts.Pid == 0) || opts.Help {
+		flagparser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
 
+	groupBy, err := perforator.ParseGroupBy(opts.GroupBy)
+	must("group-by", err)
+	if opts.MinRunning < 0 || opts.MinRunning > 1 {
+		fatal("error: --min-running must be between 0 and 1")
+	}
+	if groupBy != perforator.GroupNone {
+		opts.Summary = true
+	}
+
+	// with repeated runs only the statistics are shown
+	stats := opts.Repeat > 1
+
+	if opts.Tree {
+		opts.Summary = true
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if record {
+		if opts.Output == "" {
+			opts.Output = "perforator.json"
+		}
+		out, err = os.OpenFile(opts.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		must("open-output", err)
+	} else if (opts.Summary || stats) && opts.Output != "" {
+		out, err = os.OpenFile(opts.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		must("open-output", err)
+	}
+	defer out.Close()
+
+	rep := reporter(out, opts.Csv, perforator.ReportOptions{
+		Summary:     opts.Summary,
+		Stats:       stats,
+		SortKey:     opts.SortKey,
+		ReverseSort: opts.ReverseSort,
+		NoSort:      opts.NoSort,
+		GroupBy:     groupBy,
+		Tree:        opts.Tree,
+		Scaling: perforator.Scaling{
+			Show:       opts.ShowScaling,
+			MinRunning: opts.MinRunning,
+		},
+	})
+	var recorder *perforator.RecordReporter
+	if record {
+		// a JSON Lines record is written as the target runs, so it is
+		// usable even if perforator is killed
+		recorder = perforator.NewRecordReporter(out, filepath.Ext(opts.Output) == ".jsonl")
+		rep = perforator.MultiReporter(&diagnostics{
+			seen: make(map[string]bool),
+		}, recorder)
+	}
+
+	if opts.Pid != 0 {
+		if len(args) != 0 {
+			fatal("error: cannot give a command when attaching with --pid")
+		}
+		if stats {
+			fatal("error: --repeat cannot be used when attaching with --pid")
+		}
+	}
+
+	cfg := config(args)
+	rep, done := outputs(rep, opts.TraceOut, opts.PprofOut, opts.RangeInnerDelimiter)
+	cfg.Reporter = rep
+
+	// the regions measured before a timeout are still written
+	_, err = profile(cfg)
+	done()
+	if recorder != nil {
+		must("record", recorder.Err())
+	}
+	if err != nil {
+		out.Close()
+		fatal(err)
+	}
+}
+
+// outputs adds the reporters that write a trace to 'traceOut' and a pprof
+// profile to 'pprofOut' to rep, for the paths that are not empty. The
+// returned function must be called when the session has ended, and closes
+// the files or exits if writing them failed.
+func outputs(rep perforator.Reporter, traceOut, pprofOut, delim string) (perforator.Reporter, func()) {
+	var files []io.Closer
+	var checks []func()
+	create := func(path string) io.Writer {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		must("open-output", err)
+		files = append(files, f)
+		return f
+	}
+	if traceOut != "" {
+		tracer := perforator.NewTraceReporter(create(traceOut))
+		rep = perforator.MultiReporter(rep, tracer)
+		checks = append(checks, func() { must("trace-out", tracer.Err()) })
+	}
+	if pprofOut != "" {
+		profiler := perforator.NewPprofReporter(create(pprofOut), delim)
+		rep = perforator.MultiReporter(rep, profiler)
+		checks = append(checks, func() { must("pprof-out", profiler.Err()) })
+	}
+	return rep, func() {
+		for _, check := range checks {
+			check()
+		}
+		for _, f := range files {
+			f.Close()
+		}
+	}
+}
+
+// setup handles the options that apply before profiling: showing the version
+// and lists of events, and enabling verbose logging.
+func setup() {
 	if opts.Version {
 		fmt.Println("perforator version", Version)
 		os.Exit(0)
@@ -53,39 +203,52 @@ func main() {
 		utrace.SetLogger(logger)
 	}
 
-	if opts.List != "" {
-		var events []string
-		switch opts.List {
-		case "software":
-			events = perforator.AvailableSoftwareEvents()
-		case "hardware":
-			events = perforator.AvailableHardwareEvents()
-		case "cache":
-			events = perforator.AvailableCacheEvents()
-		case "trace":
-			events = perforator.AvailableTraceEvents()
-		default:
-			fatal("error: invalid event type", opts.List)
+	if opts.List == "metrics" {
+		if opts.Json {
+			printJSON(perforator.BuiltinFormulas())
+			os.Exit(0)
 		}
+		for _, f := range perforator.BuiltinFormulas() {
+			fmt.Printf("[metric]: %s\n", f)
+		}
+		os.Exit(0)
+	}
 
-		if len(events) == 0 {
-			fmt.Println("No events found, do you have the right permissions?")
+	if opts.List != "" {
+		events, err := perforator.ListEvents(opts.List)
+		if err != nil {
+			fatal("error:", err)
+		}
+		if opts.Json {
+			printJSON(events)
+			os.Exit(0)
 		}
 
+		n := 0
 		for _, e := range events {
-			fmt.Printf("[%s event]: %s\n", opts.List, e)
+			if e.Available {
+				fmt.Printf("[%s event]: %s\n", e.Kind, e.Name)
+				n++
+			}
+		}
+		if n == 0 {
+			fmt.Println("No events found, do you have the right permissions?")
 		}
 		os.Exit(0)
 	}
+}
 
-	if len(args) <= 0 || opts.Help {
-		flagparser.WriteHelp(os.Stdout)
-		os.Exit(0)
-	}
-
-	target := args[0]
-	args = args[1:]
+// printJSON writes a value to standard output as indented JSON.
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	must("json", enc.Encode(v))
+}
 
+// config builds the configuration of a session from the options, to profile
+// the command given by 'args' or the process given by --pid. The Reporter is
+// left for the caller to set.
+func config(args []string) perforator.Config {
 	perfOpts := perf.Options{
 		ExcludeKernel:     !opts.Kernel,
 		ExcludeHypervisor: !opts.Hypervisor,
@@ -94,6 +257,7 @@ func main() {
 
 	var configs []perf.Configurator
 	if len(opts.Events) >= 1 {
+		var err error
 		configs, err = ParseEventList(opts.Events)
 		if len(configs) == 0 {
 			fmt.Println("No events found, do you have the right permissions?")
@@ -113,36 +277,100 @@ func main() {
 		Groups: groups,
 	}
 
-	var out io.Writer = os.Stdout
-	if opts.Summary {
-		out = ioutil.Discard
+	// the events used by derived metrics are measured as well
+	var formulas []*perforator.Formula
+	for _, spec := range opts.Metrics {
+		f, err := perforator.ParseFormula(spec)
+		must("metric-parse", err)
+		must("metric-events", evs.Add(f.Events()...))
+		formulas = append(formulas, f)
+	}
+
+	recursion, err := perforator.ParseRecursion(opts.Recursion)
+	must("recursion", err)
+	counters, err := perforator.ParseCounters(opts.Counters)
+	must("counters", err)
+	scope, err := perforator.ParseScope(opts.Scope)
+	must("scope", err)
+
+	if opts.Binary != "" && !opts.FollowExec {
+		fatal("error: --binary requires --follow-exec")
 	}
-	immediate := func() perforator.MetricsWriter {
-		return metricsWriter(out)
+
+	// regions named in the configuration file are reported with their names
+	regions := make([]string, len(opts.Regions))
+	names := make([]string, len(opts.Regions))
+	for i, r := range opts.Regions {
+		regions[i] = r
+		if spec, ok := regionSpecs[r]; ok {
+			regions[i], names[i] = spec, r
+		}
 	}
 
-	total, err := perforator.Run(target, args, opts.Regions, evs, perfOpts, immediate, opts.IgnoreMissingRegions, opts.RangeInnerDelimiter, opts.ExcludeClones)
-	if err != nil {
-		fatal(err)
+	cfg := perforator.Config{
+		Pid:                  opts.Pid,
+		Regions:              regions,
+		RegionNames:          names,
+		Events:               evs,
+		Options:              perfOpts,
+		Formulas:             formulas,
+		IgnoreMissingRegions: opts.IgnoreMissingRegions,
+		RangeInnerDelimiter:  opts.RangeInnerDelimiter,
+		ExcludeClones:        opts.ExcludeClones,
+		Recursion:            recursion,
+		Counters:             counters,
+		Scope:                scope,
+		FollowExec:           opts.FollowExec,
+		Binary:               opts.Binary,
+		Repeat:               opts.Repeat,
+	}
+	if opts.Pid == 0 {
+		cfg.Target = args[0]
+		cfg.Args = args[1:]
 	}
+	return cfg
+}
 
-	if opts.Summary {
-		var out io.WriteCloser = os.Stdout
+// profile runs a session and returns the metrics that it collected. If the
+// session times out, the metrics collected until then are returned with the
+// error, so that the caller can write its outputs before exiting. With
+// --no-multiplex the target may be run once for each pass of events.
+func profile(cfg perforator.Config) (perforator.TotalMetrics, error) {
+	if opts.NoMultiplex {
+		return profilePasses(cfg)
+	}
+	return profileOnce(cfg)
+}
 
-		if opts.Output != "" {
-			f, err := os.OpenFile(opts.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "open-output :", err)
-			}
-			out = f
-		}
+// profileOnce runs a single session.
+func profileOnce(cfg perforator.Config) (perforator.TotalMetrics, error) {
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
 
-		mv := metricsWriter(out)
-		if opts.NoSort {
-			total.WriteTo(mv)
-		} else {
-			total.WriteToSorted(mv, opts.SortKey, opts.ReverseSort)
-		}
-		out.Close()
+	session := perforator.NewSession(cfg)
+	err := session.StartContext(ctx)
+	must("start", err)
+
+	if opts.Pid != 0 {
+		// Interrupting perforator must not kill the attached process, so
+		// catch the signal and detach cleanly instead.
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, unix.SIGTERM)
+		go func() {
+			<-sigs
+			session.Close()
+		}()
+	}
+
+	total, err := session.Wait()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return total, fmt.Errorf("timeout: stopped tracing after %v", opts.Timeout)
+	} else if err != nil {
+		fatal(err)
 	}
+	return total, nil
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/zyedidia/perforator"
+)
+
+// report renders a record file written by 'perforator record'.
+func report(argv []string) {
+	flagparser := flags.NewParser(&reportOpts, flags.PassDoubleDash|flags.PrintErrors)
+	flagparser.Usage = "report [OPTIONS] FILE"
+	args, err := flagparser.ParseArgs(argv)
+	if err != nil {
+		os.Exit(1)
+	}
+	if len(args) != 1 || reportOpts.Help {
+		flagparser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+
+	rec := readRecord(args[0], reportOpts.Metrics)
+
+	groupBy, err := perforator.ParseGroupBy(reportOpts.GroupBy)
+	must("group-by", err)
+	if reportOpts.MinRunning < 0 || reportOpts.MinRunning > 1 {
+		fatal("error: --min-running must be between 0 and 1")
+	}
+	summary := reportOpts.Summary || reportOpts.Tree || groupBy != perforator.GroupNone
+	// records of repeated runs show statistics, like the runs themselves
+	stats := rec.Repeat > 1
+
+	out := output(reportOpts.Output)
+	defer out.Close()
+
+	rep := reporter(out, reportOpts.Csv, perforator.ReportOptions{
+		Summary:     summary,
+		Stats:       stats,
+		SortKey:     reportOpts.SortKey,
+		ReverseSort: reportOpts.ReverseSort,
+		NoSort:      reportOpts.NoSort,
+		GroupBy:     groupBy,
+		Tree:        reportOpts.Tree,
+		Scaling: perforator.Scaling{
+			Show:       reportOpts.ShowScaling,
+			MinRunning: reportOpts.MinRunning,
+		},
+	})
+	// ranges are resolved with the delimiter that they were recorded with
+	delim := rec.RangeInnerDelimiter
+	if delim == "" {
+		delim = "-"
+	}
+	rep, done := outputs(rep, reportOpts.TraceOut, reportOpts.PprofOut, delim)
+
+	rec.Replay(rep)
+	done()
+}
+
+// diff compares two record files written by 'perforator record'.
+func diff(argv []string) {
+	flagparser := flags.NewParser(&diffOpts, flags.PassDoubleDash|flags.PrintErrors)
+	flagparser.Usage = "diff [OPTIONS] OLD NEW"
+	args, err := flagparser.ParseArgs(argv)
+	if err != nil {
+		os.Exit(1)
+	}
+	if len(args) != 2 || diffOpts.Help {
+		flagparser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+
+	old := readRecord(args[0], diffOpts.Metrics)
+	new := readRecord(args[1], diffOpts.Metrics)
+
+	out := output(diffOpts.Output)
+	defer out.Close()
+
+	writeDiff(perforator.Diff(old.Total(), new.Total()), diffOpts.Alpha, out, diffOpts.Csv)
+}
+
+// writeDiff writes a comparison with the significance level 'alpha'.
+func writeDiff(d perforator.MetricsDiff, alpha float64, out io.Writer, csv bool) {
+	if alpha <= 0 || alpha >= 1 {
+		fatal("error: --alpha must be between 0 and 1")
+	}
+	d.Alpha = alpha
+
+	var mw perforator.MetricsWriter = perforator.NewTableWriter(out)
+	if csv {
+		mw = perforator.NewCSVWriter(out)
+	}
+	d.WriteTo(mw)
+}
+
+// readRecord reads a record file and adds the derived metrics given by
+// 'metrics' to it.
+func readRecord(path string, metrics []string) *perforator.Record {
+	f, err := os.Open(path)
+	must("open-record", err)
+	rec, err := perforator.ReadRecord(f)
+	f.Close()
+	must("read-record", err)
+
+	for _, spec := range metrics {
+		f, err := perforator.ParseFormula(spec)
+		must("metric-parse", err)
+		rec.Metrics = append(rec.Metrics, f)
+	}
+	return rec
+}
+
+// output opens the file to write output to, or returns standard output if
+// 'path' is empty.
+func output(path string) io.WriteCloser {
+	if path == "" {
+		return os.Stdout
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	must("open-output", err)
+	return out
+}
@@ -0,0 +1,246 @@
+package perforator
+
+import (
+	"fmt"
+	"math"
+)
+
+// A DiffRow compares an event of a region between an old and a new run. The
+// values are the means over all invocations of the region in each run, so
+// runs with a different number of invocations can be compared.
+type DiffRow struct {
+	Region string
+	Label  string
+	Old    float64
+	New    float64
+	// InOld and InNew report whether the event was measured for the region
+	// in each run.
+	InOld bool
+	InNew bool
+	// Derived is set for derived metrics, for which it is not known whether
+	// an increase is an improvement or a regression.
+	Derived bool
+	// OldN and NewN are the number of runs that the event was measured in
+	// on each side, and P is the p-value of the Mann-Whitney U
+	// test between the mean of each run (see MannWhitney). P is NaN unless
+	// both sides have at least two runs.
+	OldN int
+	NewN int
+	P    float64
+}
+
+// Delta returns the absolute change from the old to the new value.
+func (r DiffRow) Delta() float64 {
+	return r.New - r.Old
+}
+
+// Change returns the relative change from the old to the new value as a
+// percentage. It is NaN if the old value is zero and the new one is not.
+func (r DiffRow) Change() float64 {
+	if r.Old == r.New {
+		return 0
+	}
+	if r.Old == 0 {
+		return math.NaN()
+	}
+	return 100 * (r.New - r.Old) / math.Abs(r.Old)
+}
+
+// Regressed returns true if the event increased, since fewer events and less
+// time are better. It is always false for derived metrics.
+func (r DiffRow) Regressed() bool {
+	return r.InOld && r.InNew && !r.Derived && r.New > r.Old
+}
+
+// Improved returns true if the event decreased. It is always false for
+// derived metrics.
+func (r DiffRow) Improved() bool {
+	return r.InOld && r.InNew && !r.Derived && r.New < r.Old
+}
+
+// Significant returns true if the change is statistically significant at
+// the level 'alpha', or if there are too few samples to test it.
+func (r DiffRow) Significant(alpha float64) bool {
+	return math.IsNaN(r.P) || r.P <= alpha
+}
+
+// DefaultAlpha is the default significance level of a MetricsDiff.
+const DefaultAlpha = 0.05
+
+// MetricsDiff is the comparison of every region and event of two runs.
+type MetricsDiff struct {
+	Rows []DiffRow
+	// Alpha is the significance level: changes with a p-value above it are
+	// not significant and are marked with '~'.
+	Alpha float64
+}
+
+// Diff compares the metrics of an old and a new run, matching regions by name
+// and events by label. Regions and events are listed in the order in which
+// they first appear in the old run, followed by those that only appear in the
+// new run. The invocations of a region in one run are not independent, so
+// they are averaged into one sample per run (see NamedMetrics.Run), and if both sides have
+// several runs (for example with repeated runs), each change is tested for
+// significance with the Mann-Whitney U test.
+func Diff(old, new TotalMetrics) MetricsDiff {
+	oldRegions := old.samples()
+	newRegions := new.samples()
+	find := func(regions []*regionSamples, name string) *regionSamples {
+		for _, s := range regions {
+			if s.name == name {
+				return s
+			}
+		}
+		return nil
+	}
+
+	diff := MetricsDiff{
+		Alpha: DefaultAlpha,
+	}
+	compare := func(o, n *regionSamples) {
+		var labels []string
+		var name string
+		if o != nil {
+			name = o.name
+			labels = append(labels, o.labels...)
+		}
+		if n != nil {
+			name = n.name
+			for _, label := range n.labels {
+				if o != nil {
+					if _, ok := o.values[label]; ok {
+						continue
+					}
+				}
+				labels = append(labels, label)
+			}
+		}
+		for _, label := range labels {
+			row := DiffRow{
+				Region: name,
+				Label:  label,
+				Old:    math.NaN(),
+				New:    math.NaN(),
+				P:      math.NaN(),
+			}
+			var oldRuns, newRuns []float64
+			if o != nil {
+				if vals, ok := o.values[label]; ok {
+					row.InOld = true
+					row.Old = mean(vals)
+					row.Derived = o.derived[label]
+					oldRuns = perRun(vals, o.runs[label])
+					row.OldN = len(oldRuns)
+				}
+			}
+			if n != nil {
+				if vals, ok := n.values[label]; ok {
+					row.InNew = true
+					row.New = mean(vals)
+					row.Derived = row.Derived || n.derived[label]
+					newRuns = perRun(vals, n.runs[label])
+					row.NewN = len(newRuns)
+				}
+			}
+			if row.OldN >= 2 && row.NewN >= 2 {
+				row.P = MannWhitney(oldRuns, newRuns)
+			}
+			diff.Rows = append(diff.Rows, row)
+		}
+	}
+
+	for _, o := range oldRegions {
+		compare(o, find(newRegions, o.name))
+	}
+	for _, n := range newRegions {
+		if find(oldRegions, n.name) == nil {
+			compare(nil, n)
+		}
+	}
+	return diff
+}
+
+// mean returns the mean of the samples, or NaN if there are none.
+func mean(samples []float64) float64 {
+	if len(samples) == 0 {
+		return math.NaN()
+	}
+	return Summarize(samples).Mean
+}
+
+// perRun returns the mean of the samples of each run, in the order in which
+// the runs first appear.
+func perRun(samples []float64, runs []int) []float64 {
+	var sums []float64
+	var counts []int
+	index := make(map[int]int)
+	for i, v := range samples {
+		j, ok := index[runs[i]]
+		if !ok {
+			j = len(sums)
+			index[runs[i]] = j
+			sums = append(sums, 0)
+			counts = append(counts, 0)
+		}
+		sums[j] += v
+		counts[j]++
+	}
+	for j := range sums {
+		sums[j] /= float64(counts[j])
+	}
+	return sums
+}
+
+// formatDiff formats the value of an event in a diff.
+func formatDiff(r DiffRow, v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "n/a"
+	}
+	if r.Derived {
+		return formatDerived(v)
+	}
+	return formatStat(r.Label, v)
+}
+
+// WriteTo pretty-prints the comparison and writes the result to a
+// MetricsWriter, with one row for each region and event. Regressions are
+// marked with an up arrow and improvements with a down arrow, changes that
+// are not significant are marked with '~', and events that were only
+// measured in one of the runs are flagged.
+func (d MetricsDiff) WriteTo(table MetricsWriter) {
+	table.SetHeader([]string{"region", "event", "old", "new", "delta", "change", "p", ""})
+
+	for _, r := range d.Rows {
+		var old, new, delta, change, p, mark string
+		switch {
+		case !r.InNew:
+			old, new, mark = formatDiff(r, r.Old), "-", "only in old"
+		case !r.InOld:
+			old, new, mark = "-", formatDiff(r, r.New), "only in new"
+		default:
+			old, new = formatDiff(r, r.Old), formatDiff(r, r.New)
+			delta = formatDiff(r, r.Delta())
+			if !math.IsNaN(r.Delta()) && r.Delta() > 0 {
+				delta = "+" + delta
+			}
+			if c := r.Change(); !math.IsNaN(c) {
+				change = fmt.Sprintf("%+.2f%%", c)
+			} else {
+				change = "n/a"
+			}
+			if !math.IsNaN(r.P) {
+				p = fmt.Sprintf("p=%.3f n=%d+%d", r.P, r.OldN, r.NewN)
+			}
+			if !r.Significant(d.Alpha) {
+				change = "~"
+			} else if r.Regressed() {
+				mark = "▲ worse"
+			} else if r.Improved() {
+				mark = "▼ better"
+			}
+		}
+		table.Append([]string{r.Region, r.Label, old, new, delta, change, p, mark})
+	}
+
+	table.Render()
+}
@@ -0,0 +1,92 @@
+package perforator
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	ins := func(v uint64) Result { return count("instructions", v) }
+	miss := func(v uint64) Result { return count("cache-misses", v) }
+
+	old := TotalMetrics{
+		named("a", 10, ins(100), miss(10)),
+		named("a", 30, ins(300), miss(30)),
+		named("b", 5, ins(50), miss(5)),
+	}
+	new := TotalMetrics{
+		named("a", 20, ins(150), miss(20)),
+		named("c", 5, ins(10), miss(1)),
+	}
+	new[0].Results = append(new[0].Results, Result{Label: "branch-misses", Value: 3})
+
+	type row struct {
+		region, label string
+		old, new      float64
+		inOld, inNew  bool
+	}
+	want := []row{
+		{"a", "instructions", 200, 150, true, true},
+		{"a", "cache-misses", 20, 20, true, true},
+		{"a", "time-elapsed", 20, 20, true, true},
+		{"a", "branch-misses", math.NaN(), 3, false, true},
+		{"b", "instructions", 50, math.NaN(), true, false},
+		{"b", "cache-misses", 5, math.NaN(), true, false},
+		{"b", "time-elapsed", 5, math.NaN(), true, false},
+		{"c", "instructions", math.NaN(), 10, false, true},
+		{"c", "cache-misses", math.NaN(), 1, false, true},
+		{"c", "time-elapsed", math.NaN(), 5, false, true},
+	}
+	same := func(a, b float64) bool {
+		return a == b || math.IsNaN(a) && math.IsNaN(b)
+	}
+
+	d := Diff(old, new)
+	if len(d.Rows) != len(want) {
+		t.Fatalf("got %d rows, want %d: %+v", len(d.Rows), len(want), d.Rows)
+	}
+	for i, w := range want {
+		r := d.Rows[i]
+		if r.Region != w.region || r.Label != w.label || !same(r.Old, w.old) || !same(r.New, w.new) || r.InOld != w.inOld || r.InNew != w.inNew {
+			t.Errorf("row %d: got %+v, want %+v", i, r, w)
+		}
+	}
+
+	rows := d.Rows
+	if !rows[0].Improved() || rows[0].Regressed() || rows[0].Change() != -25 {
+		t.Errorf("instructions: expected an improvement of 25%%, got %+v (%.2f%%)", rows[0], rows[0].Change())
+	}
+	if rows[1].Improved() || rows[1].Regressed() || rows[1].Change() != 0 {
+		t.Errorf("cache-misses: expected no change, got %+v", rows[1])
+	}
+	if rows[3].Improved() || rows[3].Regressed() {
+		t.Errorf("branch-misses: only in new, got %+v", rows[3])
+	}
+	// a single sample in the new run cannot be tested
+	if !math.IsNaN(rows[0].P) || !rows[0].Significant(d.Alpha) {
+		t.Errorf("instructions: expected no p-value, got %+v", rows[0])
+	}
+}
+
+func TestDiffRuns(t *testing.T) {
+	var old, new TotalMetrics
+	// many invocations in few runs are few samples, whatever processes the
+	// runs had
+	for run := 1; run <= 3; run++ {
+		for i := 0; i < 10; i++ {
+			o := named("a", 10, count("instructions", uint64(100+run))).on(10*run+i%2, 10*run+i%2, "old")
+			o.Run = run - 1
+			n := named("a", 10, count("instructions", uint64(200+run)))
+			n.Run = run - 1
+			old, new = append(old, o), append(new, n)
+		}
+	}
+	r := Diff(old, new).Rows[0]
+	if r.OldN != 3 || r.NewN != 3 || r.Old != 102 || r.New != 202 {
+		t.Errorf("got %+v, want 3 runs on each side", r)
+	}
+	// with 3 runs on each side, the smallest two-sided p-value is 0.1
+	if want := MannWhitney([]float64{101, 102, 103}, []float64{201, 202, 203}); r.P != want || r.Significant(DefaultAlpha) {
+		t.Errorf("got p=%v, want %v from the means of the runs", r.P, want)
+	}
+}
@@ -3,16 +3,14 @@ package perforator
 import (
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/zyedidia/perf"
 )
 
-const (
-	traceDir = "/sys/kernel/debug/tracing"
-)
-
 var hardwareEvents = map[string]perf.HardwareCounter{
 	"instructions":            perf.Instructions,
 	"cpu-cycles":              perf.CPUCycles,
@@ -147,30 +145,411 @@ func AvailableCacheEvents() []string {
 
 // AvailableTraceEvents returns the list of available trace events.
 func AvailableTraceEvents() []string {
-	events, err := ioutil.ReadFile(traceDir + "/available_events")
+	events, err := ioutil.ReadFile(filepath.Join(tracingDir(), "available_events"))
 	if err != nil {
 		return nil
 	}
-	lines := strings.Split(string(events), "\n")
+	var lines []string
+	for _, line := range strings.Split(string(events), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
 	sort.Strings(lines)
 	return lines
 }
 
+// An EventInfo describes an event in the catalogue of events.
+type EventInfo struct {
+	Name string `json:"name"`
+	// Kind is hardware, software, cache, pmu or trace.
+	Kind string `json:"kind"`
+	// Type and Config are the type and configs passed to perf_event_open.
+	Type        uint32 `json:"type"`
+	Config      uint64 `json:"config"`
+	Config1     uint64 `json:"config1,omitempty"`
+	Config2     uint64 `json:"config2,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Available is true if the event can be opened on this system. Trace
+	// events are assumed to be available.
+	Available bool `json:"available"`
+}
+
+// EventKinds are the kinds of events in the catalogue.
+var EventKinds = []string{"hardware", "software", "cache", "pmu", "trace"}
+
+var hardwareDescriptions = map[string]string{
+	"instructions":            "Retired instructions",
+	"cpu-cycles":              "Total cycles",
+	"cache-references":        "Cache accesses, usually to the last level cache",
+	"cache-misses":            "Cache misses, usually in the last level cache",
+	"branch-instructions":     "Retired branch instructions",
+	"branch-misses":           "Mispredicted branch instructions",
+	"bus-cycles":              "Bus cycles",
+	"stalled-cycles-frontend": "Stalled cycles during issue",
+	"stalled-cycles-backend":  "Stalled cycles during retirement",
+	"ref-cycles":              "Total cycles, not affected by CPU frequency scaling",
+}
+
+var softwareDescriptions = map[string]string{
+	"cpu-clock":        "The CPU clock, a high-resolution per-CPU timer",
+	"task-clock":       "A clock count specific to the task that is running",
+	"page-faults":      "Page faults",
+	"context-switches": "Context switches",
+	"cpu-migrations":   "Migrations of the task to a new CPU",
+	"minor-faults":     "Minor page faults, which did not require disk I/O",
+	"major-faults":     "Major page faults, which required disk I/O",
+	"alignment-faults": "Alignment faults, when unaligned memory accesses are emulated",
+	"emulation-faults": "Instructions that had to be emulated",
+}
+
+var cacheDescriptions = map[string]string{
+	"l1d":      "L1 data cache",
+	"l1i":      "L1 instruction cache",
+	"ll":       "Last level cache",
+	"dtlb":     "Data TLB",
+	"itlb":     "Instruction TLB",
+	"bpu":      "Branch prediction unit",
+	"node":     "Local memory node",
+	"read":     "read",
+	"write":    "write",
+	"prefetch": "prefetch",
+}
+
+// ListEvents returns the catalogue of events of a kind (see EventKinds), or
+// of every kind if 'kind' is "all", sorted by name within each kind.
+func ListEvents(kind string) ([]EventInfo, error) {
+	if kind == "all" {
+		var all []EventInfo
+		for _, k := range EventKinds {
+			events, err := ListEvents(k)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, events...)
+		}
+		return all, nil
+	}
+
+	var events []EventInfo
+	add := func(name string, c perf.Configurator, desc string) {
+		var attr perf.Attr
+		if c.Configure(&attr) != nil {
+			return
+		}
+		events = append(events, EventInfo{
+			Name:        name,
+			Kind:        kind,
+			Type:        uint32(attr.Type),
+			Config:      attr.Config,
+			Config1:     attr.Config1,
+			Config2:     attr.Config2,
+			Description: desc,
+			Available:   kind == "trace" || IsAvailable(c),
+		})
+	}
+	switch kind {
+	case "hardware":
+		for name, ev := range hardwareEvents {
+			add(name, ev, hardwareDescriptions[name])
+		}
+	case "software":
+		for name, ev := range softwareEvents {
+			add(name, ev, softwareDescriptions[name])
+		}
+	case "cache":
+		for name, ev := range cacheEvents() {
+			parts := strings.Split(name, "-")
+			add(name, ev, fmt.Sprintf("%s %s %s", cacheDescriptions[parts[0]], cacheDescriptions[parts[1]], parts[2]))
+		}
+	case "pmu":
+		for _, p := range pmus() {
+			for name, info := range p.events {
+				ev, err := pmuEvent(p.name + "/" + name + "/")
+				if err != nil {
+					continue
+				}
+				desc := info.terms
+				if info.scale != "" {
+					desc += ", scale " + info.scale
+				}
+				if info.unit != "" {
+					desc += ", unit " + info.unit
+				}
+				add(ev.label, ev, desc)
+			}
+		}
+	case "trace":
+		for _, name := range AvailableTraceEvents() {
+			if ev, err := tracepoint(name); err == nil {
+				add(name, ev, "")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid event type %s", kind)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Name < events[j].Name
+	})
+	return events, nil
+}
+
 // NameToConfig converts a string representation of an event to a perf
-// configurator.
+// configurator. Besides the names listed by the Available*Events functions,
+// it accepts the syntax of 'perf list' and 'perf stat':
+//
+//   - aliases such as cycles, branches and L1-dcache-load-misses, which are
+//     labeled with the names above (cpu-cycles, branch-instructions and
+//     l1d-read-misses)
+//   - raw events written as rNNNN, where NNNN is the hexadecimal config
+//   - PMU events such as cpu/event=0x3c,umask=0x00,cmask=1/, whose terms are
+//     placed in the config according to the PMU's format in sysfs, or set
+//     config, config1, config2 or the label (name=...) directly. A term may
+//     also be an event named by the PMU, as in cpu/mem-loads/
+//   - tracepoints written as subsystem:event
+//
+// Any event may be followed by modifiers, as in instructions:u: u, k and h
+// count only user, kernel or hypervisor code (several may be combined), and
+// each p increases the requested precision. Modifiers only apply to their
+// event and override the options of the session.
 func NameToConfig(name string) (perf.Configurator, error) {
+	if i := strings.LastIndex(name, ":"); i > 0 {
+		if mods, err := parseModifiers(name[i+1:]); err == nil {
+			if ev, err := eventToConfig(name[:i]); err == nil {
+				mods.Configurator = ev
+				mods.label = label(ev, name[:i]) + name[i:]
+				return mods, nil
+			}
+		}
+	}
+	if strings.Contains(name, "/") && !strings.HasSuffix(name, "/") {
+		// PMU events may have modifiers without a colon
+		i := strings.LastIndex(name, "/")
+		mods, err := parseModifiers(name[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("event %s: %w", name, err)
+		}
+		ev, err := eventToConfig(name[:i+1])
+		if err != nil {
+			return nil, err
+		}
+		mods.Configurator = ev
+		mods.label = label(ev, name[:i+1]) + name[i+1:]
+		return mods, nil
+	}
+	return eventToConfig(name)
+}
+
+// eventToConfig converts an event without modifiers to a perf configurator.
+func eventToConfig(name string) (perf.Configurator, error) {
 	if ev, ok := hardwareEvents[name]; ok {
 		return ev, nil
 	} else if ev, ok := softwareEvents[name]; ok {
 		return ev, nil
 	} else if ev, ok := cacheEvents()[name]; ok {
 		return ev, nil
+	} else if ev, ok := hardwareAliases[name]; ok {
+		return ev, nil
+	} else if ev, ok := softwareAliases[name]; ok {
+		return ev, nil
+	} else if ev, ok := perfCacheEvent(name); ok {
+		return ev, nil
+	} else if ev, ok := rawConfig(name); ok {
+		return ev, nil
+	} else if strings.HasSuffix(name, "/") {
+		return pmuEvent(name)
 	} else if strings.Contains(name, ":") {
-		parts := strings.Split(name, ":")
-		subsystem, event := parts[0], parts[1]
-		config := perf.Tracepoint(subsystem, event)
-		return config, nil
+		return tracepoint(name)
 	}
 
 	return nil, fmt.Errorf("not found: event %s", name)
 }
+
+// eventLabel returns the label that the event 'name' is reported with, which
+// differs from the name for aliases such as "cycles". Names that are not
+// events, such as "time-elapsed" or derived metrics, are returned unchanged.
+func eventLabel(name string) string {
+	if name == "time-elapsed" {
+		return name
+	}
+	c, err := NameToConfig(name)
+	if err != nil {
+		return name
+	}
+	return label(c, name)
+}
+
+// label returns the label of an event, or 'name' if it cannot be
+// configured.
+func label(c perf.Configurator, name string) string {
+	var attr perf.Attr
+	if c.Configure(&attr) != nil || attr.Label == "" {
+		return name
+	}
+	return attr.Label
+}
+
+// the names used by perf for some hardware and software events
+var hardwareAliases = map[string]perf.HardwareCounter{
+	"cycles":               perf.CPUCycles,
+	"branches":             perf.BranchInstructions,
+	"idle-cycles-frontend": perf.StalledCyclesFrontend,
+	"idle-cycles-backend":  perf.StalledCyclesBackend,
+}
+
+var softwareAliases = map[string]perf.SoftwareCounter{
+	"faults":     perf.PageFaults,
+	"cs":         perf.ContextSwitches,
+	"migrations": perf.CPUMigrations,
+}
+
+// the names used by perf for the parts of cache events, mapped to the names
+// in caches, cacheAccesses and cacheResults
+var (
+	perfCaches = []struct {
+		names []string
+		cache string
+	}{
+		{[]string{"l1-dcache", "l1-d", "l1d", "l1-data"}, "l1d"},
+		{[]string{"l1-icache", "l1-i", "l1i", "l1-instruction"}, "l1i"},
+		{[]string{"llc", "l2"}, "ll"},
+		{[]string{"dtlb", "d-tlb", "data-tlb"}, "dtlb"},
+		{[]string{"itlb", "i-tlb", "instruction-tlb"}, "itlb"},
+		{[]string{"branch", "branches", "bpu", "btb", "bpc"}, "bpu"},
+		{[]string{"node"}, "node"},
+	}
+	perfCacheOps = map[string]string{
+		"load":             "read",
+		"loads":            "read",
+		"read":             "read",
+		"store":            "write",
+		"stores":           "write",
+		"write":            "write",
+		"prefetch":         "prefetch",
+		"prefetches":       "prefetch",
+		"speculative-read": "prefetch",
+		"speculative-load": "prefetch",
+	}
+	perfCacheResults = map[string]string{
+		"refs":      "accesses",
+		"reference": "accesses",
+		"ops":       "accesses",
+		"access":    "accesses",
+		"misses":    "misses",
+		"miss":      "misses",
+	}
+)
+
+// perfCacheEvent parses a cache event named as in perf, such as
+// L1-dcache-load-misses or LLC-loads, written as cache-op[-result]. The
+// result defaults to accesses.
+func perfCacheEvent(name string) (cacheEvent, bool) {
+	lower := strings.ToLower(name)
+	for _, c := range perfCaches {
+		for _, cn := range c.names {
+			if !strings.HasPrefix(lower, cn+"-") {
+				continue
+			}
+			rest := lower[len(cn)+1:]
+			result := "accesses"
+			for rn, r := range perfCacheResults {
+				if strings.HasSuffix(rest, "-"+rn) {
+					if _, ok := perfCacheOps[strings.TrimSuffix(rest, "-"+rn)]; ok {
+						rest, result = strings.TrimSuffix(rest, "-"+rn), r
+						break
+					}
+				}
+			}
+			if op, ok := perfCacheOps[rest]; ok {
+				ev, ok := cacheEvents()[c.cache+"-"+op+"-"+result]
+				return ev, ok
+			}
+		}
+	}
+	return cacheEvent{}, false
+}
+
+// A rawEvent is an event given by its type and config, such as a raw event
+// or an event of a PMU.
+type rawEvent struct {
+	typ    perf.EventType
+	config [3]uint64
+	label  string
+}
+
+func (e rawEvent) Configure(attr *perf.Attr) error {
+	attr.Type = e.typ
+	attr.Config = e.config[0]
+	attr.Config1 = e.config[1]
+	attr.Config2 = e.config[2]
+	attr.Label = e.label
+	return nil
+}
+
+// rawConfig parses a raw event written as rNNNN.
+func rawConfig(name string) (rawEvent, bool) {
+	if len(name) < 2 || name[0] != 'r' {
+		return rawEvent{}, false
+	}
+	config, err := strconv.ParseUint(name[1:], 16, 64)
+	if err != nil {
+		return rawEvent{}, false
+	}
+	return rawEvent{
+		typ:    perf.RawEvent,
+		config: [3]uint64{config},
+		label:  name,
+	}, true
+}
+
+// A modifiedEvent is an event with modifiers, which select the privilege
+// levels that are counted and the precision.
+type modifiedEvent struct {
+	perf.Configurator
+	label string
+	// the privilege levels to count, or all if none is set
+	user, kernel, hypervisor bool
+	precise                  perf.Skid
+}
+
+// parseModifiers parses the modifiers of an event, such as 'u' or 'kpp'.
+func parseModifiers(s string) (*modifiedEvent, error) {
+	if s == "" {
+		return nil, fmt.Errorf("missing modifiers")
+	}
+	e := &modifiedEvent{}
+	for _, c := range s {
+		switch c {
+		case 'u':
+			e.user = true
+		case 'k':
+			e.kernel = true
+		case 'h':
+			e.hypervisor = true
+		case 'p':
+			if e.precise == perf.MustHaveZeroSkid {
+				return nil, fmt.Errorf("too many p modifiers")
+			}
+			e.precise++
+		default:
+			return nil, fmt.Errorf("invalid modifier %q", c)
+		}
+	}
+	return e, nil
+}
+
+func (e *modifiedEvent) Configure(attr *perf.Attr) error {
+	if err := e.Configurator.Configure(attr); err != nil {
+		return err
+	}
+	attr.Label = e.label
+	if e.user || e.kernel || e.hypervisor {
+		attr.Options.ExcludeUser = !e.user
+		attr.Options.ExcludeKernel = !e.kernel
+		attr.Options.ExcludeHypervisor = !e.hypervisor
+	}
+	if e.precise > 0 {
+		attr.Options.PreciseIP = e.precise
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package perforator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zyedidia/perf"
+)
+
+// fakeSysfs creates a sysfs tree with a core PMU, a power PMU with a named
+// event and a tracepoint, and makes it the sysfs root until the test ends.
+func fakeSysfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"bus/event_source/devices/cpu/type":                      "4\n",
+		"bus/event_source/devices/cpu/format/event":              "config:0-7\n",
+		"bus/event_source/devices/cpu/format/umask":              "config:8-15\n",
+		"bus/event_source/devices/cpu/format/inv":                "config:23\n",
+		"bus/event_source/devices/cpu/format/cmask":              "config:24-31\n",
+		"bus/event_source/devices/cpu/format/ldlat":              "config1:0-15\n",
+		"bus/event_source/devices/cpu/format/offset":             "config2:0-3,8-11\n",
+		"bus/event_source/devices/cpu/events/mem-loads":          "event=0xcd,umask=0x1,ldlat=3\n",
+		"bus/event_source/devices/power/type":                    "21\n",
+		"bus/event_source/devices/power/format/event":            "config:0-7\n",
+		"bus/event_source/devices/power/events/energy-pkg":       "event=0x02\n",
+		"bus/event_source/devices/power/events/energy-pkg.unit":  "Joules\n",
+		"bus/event_source/devices/power/events/energy-pkg.scale": "2.3283064365386962890625e-10\n",
+		"kernel/tracing/available_events":                        "sched:sched_switch\n",
+		"kernel/tracing/events/sched/sched_switch/id":            "316\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := sysfsRoot
+	SetSysfsRoot(dir)
+	t.Cleanup(func() {
+		SetSysfsRoot(root)
+		os.RemoveAll(dir)
+	})
+}
+
+func TestNameToConfig(t *testing.T) {
+	fakeSysfs(t)
+
+	tests := []struct {
+		name   string
+		label  string
+		typ    perf.EventType
+		config [3]uint64
+	}{
+		{"cycles", "cpu-cycles", perf.HardwareEvent, [3]uint64{uint64(perf.CPUCycles)}},
+		{"branches", "branch-instructions", perf.HardwareEvent, [3]uint64{uint64(perf.BranchInstructions)}},
+		{"cs", "context-switches", perf.SoftwareEvent, [3]uint64{uint64(perf.ContextSwitches)}},
+		{"L1-dcache-load-misses", "l1d-read-misses", perf.HardwareCacheEvent, [3]uint64{uint64(perf.L1D) | uint64(perf.Read)<<8 | uint64(perf.Miss)<<16}},
+		{"LLC-loads", "ll-read-accesses", perf.HardwareCacheEvent, [3]uint64{uint64(perf.LL) | uint64(perf.Read)<<8 | uint64(perf.Access)<<16}},
+		{"dTLB-stores", "dtlb-write-accesses", perf.HardwareCacheEvent, [3]uint64{uint64(perf.DTLB) | uint64(perf.Write)<<8 | uint64(perf.Access)<<16}},
+		{"r01c2", "r01c2", perf.RawEvent, [3]uint64{0x1c2}},
+		{"cpu/event=0x3c,umask=0x01,cmask=1,inv/", "cpu/event=0x3c,umask=0x01,cmask=1,inv/", 4, [3]uint64{0x3c | 0x100 | 1<<23 | 1<<24}},
+		{"cpu/event=0xcd,ldlat=3,offset=0x21,name=loads/", "loads", 4, [3]uint64{0xcd, 3, 0x201}},
+		{"cpu/config=0x1234,config1=5/", "cpu/config=0x1234,config1=5/", 4, [3]uint64{0x1234, 5}},
+		{"cpu/mem-loads,ldlat=8/", "cpu/mem-loads,ldlat=8/", 4, [3]uint64{0x1cd, 3 | 8}},
+		{"power/energy-pkg/", "power/energy-pkg/", 21, [3]uint64{2}},
+		{"sched:sched_switch", "sched:sched_switch", perf.TracepointEvent, [3]uint64{316}},
+	}
+	for _, tt := range tests {
+		c, err := NameToConfig(tt.name)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var attr perf.Attr
+		c.Configure(&attr)
+		if attr.Label != tt.label || attr.Type != tt.typ || [3]uint64{attr.Config, attr.Config1, attr.Config2} != tt.config {
+			t.Errorf("%s: got %s type %d config %x/%x/%x, want %s type %d config %x",
+				tt.name, attr.Label, attr.Type, attr.Config, attr.Config1, attr.Config2, tt.label, tt.typ, tt.config)
+		}
+	}
+
+	// modifiers only change the exclude flags of their event
+	mods := []struct {
+		name             string
+		label            string
+		user, kernel, hv bool
+		precise          perf.Skid
+	}{
+		{"instructions", "instructions", true, false, false, 0},
+		{"instructions:u", "instructions:u", false, true, true, 0},
+		{"cycles:kpp", "cpu-cycles:kpp", true, false, true, 2},
+		{"cpu/event=0x3c/uk", "cpu/event=0x3c/uk", false, false, true, 0},
+	}
+	for _, m := range mods {
+		c, err := NameToConfig(m.name)
+		if err != nil {
+			t.Errorf("%s: %v", m.name, err)
+			continue
+		}
+		attr := perf.Attr{Options: perf.Options{ExcludeUser: true}}
+		c.Configure(&attr)
+		o := attr.Options
+		if attr.Label != m.label || o.ExcludeUser != m.user || o.ExcludeKernel != m.kernel || o.ExcludeHypervisor != m.hv || o.PreciseIP != m.precise {
+			t.Errorf("%s: got %s %+v", m.name, attr.Label, o)
+		}
+	}
+
+	for _, bad := range []string{"nosuch", "cpu/event=0x100/", "cpu/nosuch=1/", "gpu/event=1/", "cpu/event=1/x", "sched:nosuch"} {
+		if _, err := NameToConfig(bad); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestListEvents(t *testing.T) {
+	fakeSysfs(t)
+
+	events, err := ListEvents("pmu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Name != "cpu/mem-loads/" || events[1].Name != "power/energy-pkg/" {
+		t.Fatalf("unexpected PMU events: %+v", events)
+	}
+	if e := events[1]; e.Type != 21 || e.Config != 2 || e.Description != "event=0x02, scale 2.3283064365386962890625e-10, unit Joules" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	events, err = ListEvents("trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Config != 316 || !events[0].Available {
+		t.Errorf("unexpected trace events: %+v", events)
+	}
+
+	if _, err := ListEvents("bogus"); err == nil {
+		t.Error("expected an error for an invalid kind")
+	}
+}
@@ -0,0 +1,326 @@
+package perforator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A Formula computes a derived metric, such as the number of instructions
+// per cycle, from the results of other events. A formula is an arithmetic
+// expression with +, -, *, / and parentheses over numbers and event labels,
+// where "time-elapsed" is the elapsed time in nanoseconds. Event labels may
+// contain dashes, so a subtraction must be written with spaces around the
+// minus sign ('a - b').
+type Formula struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+
+	root   expr
+	events []string
+}
+
+// builtinFormulas is the catalogue of formulas that can be used by name.
+var builtinFormulas = []struct {
+	name string
+	expr string
+}{
+	{"ipc", "instructions / cpu-cycles"},
+	{"cpi", "cpu-cycles / instructions"},
+	{"branch-miss-rate", "branch-misses / branch-instructions"},
+	{"cache-miss-rate", "cache-misses / cache-references"},
+	{"ns-per-instruction", "time-elapsed / instructions"},
+}
+
+// BuiltinFormulas returns the formulas that ParseFormula accepts by name.
+func BuiltinFormulas() []*Formula {
+	formulas := make([]*Formula, len(builtinFormulas))
+	for i, b := range builtinFormulas {
+		f, err := NewFormula(b.name, b.expr)
+		if err != nil {
+			panic(err)
+		}
+		formulas[i] = f
+	}
+	return formulas
+}
+
+// ParseFormula parses a formula written as 'name=expr', or the name of one of
+// the built-in formulas.
+func ParseFormula(spec string) (*Formula, error) {
+	if i := strings.Index(spec, "="); i >= 0 {
+		return NewFormula(strings.TrimSpace(spec[:i]), spec[i+1:])
+	}
+	for _, b := range builtinFormulas {
+		if b.name == spec {
+			return NewFormula(b.name, b.expr)
+		}
+	}
+	return nil, fmt.Errorf("not found: metric %s", spec)
+}
+
+// NewFormula parses the expression of a formula with the given name.
+func NewFormula(name, expression string) (*Formula, error) {
+	if name == "" {
+		return nil, fmt.Errorf("metric %s: missing name", expression)
+	}
+	p := &parser{
+		s: expression,
+	}
+	root, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("metric %s: %w", name, err)
+	}
+
+	var events []string
+	seen := make(map[string]bool)
+	for _, id := range p.idents {
+		if id != "time-elapsed" && !seen[id] {
+			seen[id] = true
+			events = append(events, id)
+		}
+	}
+	return &Formula{
+		Name:   name,
+		Expr:   strings.TrimSpace(expression),
+		root:   root,
+		events: events,
+	}, nil
+}
+
+// Events returns the labels of the events used by the formula, not including
+// the elapsed time.
+func (f *Formula) Events() []string {
+	return f.events
+}
+
+// Eval computes the formula from the given metrics. The result is NaN if an
+// event is missing or was not counted, or a division by zero occurs.
+func (f *Formula) Eval(m Metrics) float64 {
+	vals := make(map[string]float64, len(m.Results)+1)
+	for _, r := range m.Results {
+		vals[r.Label] = float64(r.Value)
+		if !r.Counted() {
+			vals[r.Label] = math.NaN()
+		}
+	}
+	vals["time-elapsed"] = float64(m.Elapsed)
+	return f.root.eval(vals)
+}
+
+// UnmarshalJSON decodes a formula with its name and expression, and parses
+// the expression.
+func (f *Formula) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Name string `json:"name"`
+		Expr string `json:"expr"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	parsed, err := NewFormula(v.Name, v.Expr)
+	if err != nil {
+		return err
+	}
+	*f = *parsed
+	return nil
+}
+
+func (f *Formula) String() string {
+	return fmt.Sprintf("%s = %s", f.Name, f.Expr)
+}
+
+type expr interface {
+	eval(vals map[string]float64) float64
+}
+
+type number float64
+
+func (n number) eval(vals map[string]float64) float64 {
+	return float64(n)
+}
+
+type ident string
+
+func (id ident) eval(vals map[string]float64) float64 {
+	v, ok := vals[string(id)]
+	if !ok {
+		return math.NaN()
+	}
+	return v
+}
+
+type neg struct {
+	x expr
+}
+
+func (n neg) eval(vals map[string]float64) float64 {
+	return -n.x.eval(vals)
+}
+
+type binary struct {
+	op   byte
+	l, r expr
+}
+
+func (b binary) eval(vals map[string]float64) float64 {
+	l, r := b.l.eval(vals), b.r.eval(vals)
+	switch b.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	}
+	if r == 0 {
+		return math.NaN()
+	}
+	return l / r
+}
+
+// A parser is a recursive descent parser for formula expressions.
+type parser struct {
+	s      string
+	pos    int
+	idents []string
+}
+
+func (p *parser) parse() (expr, error) {
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skip()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected '%c' at offset %d", p.s[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+func (p *parser) skip() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next character after any spaces, or 0 at the end.
+func (p *parser) peek() byte {
+	p.skip()
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+// sum = product {('+' | '-') product}
+func (p *parser) sum() (expr, error) {
+	l, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op, l, r}
+	}
+	return l, nil
+}
+
+// product = unary {('*' | '/') unary}
+func (p *parser) product() (expr, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op, l, r}
+	}
+	return l, nil
+}
+
+// unary = '-' unary | primary
+func (p *parser) unary() (expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return neg{x}, nil
+	}
+	return p.primary()
+}
+
+// primary = number | event | '(' sum ')'
+func (p *parser) primary() (expr, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at offset %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case isDigit(c) || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", p.s[start:p.pos])
+		}
+		return number(v), nil
+	case isLetter(c):
+		start := p.pos
+		for p.pos < len(p.s) {
+			c := p.s[p.pos]
+			// a dash is part of the label if a letter follows it
+			if c == '-' && p.pos+1 < len(p.s) && isLetter(p.s[p.pos+1]) {
+				p.pos++
+			} else if !isLetter(c) && !isDigit(c) && c != ':' && c != '.' {
+				break
+			}
+			p.pos++
+		}
+		// aliases are evaluated with the label of their event
+		id := eventLabel(p.s[start:p.pos])
+		p.idents = append(p.idents, id)
+		return ident(id), nil
+	}
+	return nil, fmt.Errorf("unexpected '%c' at offset %d", c, p.pos)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// formatDerived formats the value of a derived metric.
+func formatDerived(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "n/a"
+	}
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
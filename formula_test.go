@@ -0,0 +1,95 @@
+package perforator
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zyedidia/perf"
+)
+
+func TestFormula(t *testing.T) {
+	m := Metrics{
+		Results: []Result{
+			{Label: "instructions", Value: 300},
+			{Label: "cpu-cycles", Value: 200},
+			{Label: "l1d-read-accesses", Value: 50},
+		},
+		Elapsed: 600 * time.Nanosecond,
+	}
+
+	tests := []struct {
+		spec   string
+		value  float64
+		events []string
+	}{
+		{"ipc", 1.5, []string{"instructions", "cpu-cycles"}},
+		{"x=instructions - cpu-cycles", 100, []string{"instructions", "cpu-cycles"}},
+		// aliases are evaluated with the labels of their events
+		{"x=-(instructions+L1-dcache-loads)/2", -175, []string{"instructions", "l1d-read-accesses"}},
+		{"ipc=instructions/cycles", 1.5, []string{"instructions", "cpu-cycles"}},
+		{"x=100*cpu-cycles/instructions/2", 100.0 / 3, []string{"cpu-cycles", "instructions"}},
+		{"x=time-elapsed / instructions", 2, []string{"instructions"}},
+		{"x=2 + 3*4 - 1", 13, nil},
+	}
+	for _, tt := range tests {
+		f, err := ParseFormula(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if v := f.Eval(m); !(math.Abs(v-tt.value) <= 1e-9) {
+			t.Errorf("%s: got %f, want %f", tt.spec, v, tt.value)
+		}
+		if events := f.Events(); (len(events) != 0 || len(tt.events) != 0) && !reflect.DeepEqual(events, tt.events) {
+			t.Errorf("%s: got events %v, want %v", tt.spec, events, tt.events)
+		}
+	}
+
+	for _, spec := range []string{"x=cpu-cycles/0", "x=branch-misses"} {
+		f, err := ParseFormula(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := f.Eval(m); !math.IsNaN(v) {
+			t.Errorf("%s: got %f, want NaN", spec, v)
+		}
+	}
+
+	// an event is measured once, whichever name it is given by
+	cycles, err := NameToConfig("cycles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	evs := Events{Base: []perf.Configurator{cycles}}
+	f, _ := ParseFormula("x=instructions/cycles")
+	if err := evs.Add(append(f.Events(), "cpu-cycles", "cycles")...); err != nil {
+		t.Fatal(err)
+	}
+	if labels := evs.Labels(); !reflect.DeepEqual(labels, []string{"cpu-cycles", "instructions"}) {
+		t.Errorf("got events %v, want cpu-cycles and instructions", labels)
+	}
+
+	for _, spec := range []string{"unknown", "=ipc", "x=(instructions", "x=instructions +", "x=2 $ 3"} {
+		if _, err := ParseFormula(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestGroupDerived(t *testing.T) {
+	f, _ := ParseFormula("ipc")
+	total := TotalMetrics{
+		named("a", 0, count("instructions", 10), count("cpu-cycles", 10)),
+		named("a", 0, count("instructions", 30), count("cpu-cycles", 10)),
+	}
+	for i := range total {
+		total[i].Metrics = total[i].derive([]*Formula{f})
+	}
+	// the ratio of the sums, not the sum of the ratios
+	g := total.Group(GroupRegion)
+	if len(g) != 1 || g[0].Derived[0].Label != "ipc" || g[0].Derived[0].Value != 2 {
+		t.Errorf("unexpected grouped metrics: %+v", g)
+	}
+}
@@ -3,10 +3,11 @@ module github.com/zyedidia/perforator
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/blang/semver v3.5.1+incompatible
 	github.com/ianlancetaylor/demangle v0.0.0-20231023195312-e2daf7ba7156
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/olekukonko/tablewriter v0.0.4
-	github.com/zyedidia/perf v0.0.0-20210820191656-a7f405836330 // indirect
+	github.com/zyedidia/perf v0.0.0-20210820191656-a7f405836330
 	golang.org/x/sys v0.0.0-20201231184435-2d18734c6014
 )
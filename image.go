@@ -0,0 +1,184 @@
+package perforator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zyedidia/perforator/bininfo"
+	"github.com/zyedidia/perforator/utrace"
+)
+
+// An image is a program or shared library along with the regions resolved in
+// it. The images of programs are given to utrace as the PieOffsetter of the
+// traced processes, and find the regions in shared libraries as they are
+// loaded.
+type image struct {
+	s       *Session
+	bin     *bininfo.BinFile
+	regions []utrace.Region
+	ids     []int
+
+	// the dynamic linker and the address of its rendezvous function
+	interp     *bininfo.BinFile
+	rendezvous uint64
+}
+
+// resolve finds the regions in the image, which is the executable if 'lib' is
+// empty or the shared library at path 'lib' otherwise. Every region is given
+// a new ID for events.
+func (img *image) resolve(lib string) error {
+	s := img.s
+	regions, ids, err := s.resolveRegions(img.bin, lib, !s.cfg.FollowExec || s.cfg.Binary != "")
+	if err != nil {
+		return err
+	}
+	img.regions = regions
+	for _, id := range ids {
+		img.ids = append(img.ids, len(s.regionIds))
+		s.regionIds = append(s.regionIds, id)
+	}
+	return nil
+}
+
+// PieOffset returns the PIE offset of the program in the process 'pid'.
+func (img *image) PieOffset(pid int) (uint64, error) {
+	if img.bin == nil {
+		return 0, nil
+	}
+	return img.bin.PieOffset(pid)
+}
+
+// Rendezvous returns the address of the dynamic linker's rendezvous function
+// in the process 'pid' if any regions are in shared libraries.
+func (img *image) Rendezvous(pid int) (uint64, error) {
+	if img.bin == nil || img.bin.Interp() == "" || len(img.s.libs) == 0 {
+		return 0, nil
+	}
+	if img.interp == nil {
+		interp, err := bininfo.FromPidFile(pid, img.bin.Interp())
+		if err != nil {
+			return 0, err
+		}
+		addr, err := interp.FuncToPC("_dl_debug_state", false)
+		if err != nil {
+			return 0, err
+		}
+		img.interp, img.rendezvous = interp, addr
+	}
+	off, err := img.interp.PieOffset(pid)
+	if err != nil {
+		return 0, err
+	}
+	return img.rendezvous + off, nil
+}
+
+// Library returns the regions in the shared library at 'path', which has
+// been loaded by the process 'pid'.
+func (img *image) Library(pid int, path string) ([]utrace.Region, []int, error) {
+	s := img.s
+	lib, ok := s.images[path]
+	if !ok {
+		lib = &image{
+			s: s,
+		}
+		for name := range s.libs {
+			if matchLibrary(name, path) {
+				s.libs[name] = true
+				if lib.bin != nil {
+					continue
+				}
+				bin, err := bininfo.FromPidFile(pid, path)
+				if err != nil {
+					return nil, nil, fmt.Errorf("elf-read: %w", err)
+				}
+				lib.bin = bin
+			}
+		}
+		if lib.bin != nil {
+			err := lib.resolve(path)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		s.images[path] = lib
+	}
+	return lib.regions, lib.ids, nil
+}
+
+// image returns the regions to trace in the program at 'path', resolving them
+// the first time the program is seen. Programs that do not match the binary
+// filter have no regions.
+func (s *Session) image(path string, bin *bininfo.BinFile) (*image, error) {
+	if img, ok := s.images[path]; ok {
+		return img, nil
+	}
+
+	img := &image{
+		s: s,
+	}
+	if s.matchBinary(path) {
+		s.matched = true
+		img.bin = bin
+		err := img.resolve("")
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.images[path] = img
+	return img, nil
+}
+
+// matchBinary returns true if the regions should be resolved in the program
+// at 'path'.
+func (s *Session) matchBinary(path string) bool {
+	if s.cfg.Binary == "" {
+		return true
+	}
+	if strings.Contains(s.cfg.Binary, "/") {
+		return realpath(s.cfg.Binary) == path
+	}
+	return filepath.Base(path) == s.cfg.Binary
+}
+
+// exec is called when a traced process has executed a new program, and
+// returns the regions to trace in it.
+func (s *Session) exec(pid int) (utrace.PieOffsetter, []utrace.Region, []int, error) {
+	path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	path = strings.TrimSuffix(path, " (deleted)")
+
+	img, ok := s.images[path]
+	if !ok {
+		var bin *bininfo.BinFile
+		if s.matchBinary(path) {
+			bin, err = bininfo.FromPid(pid)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("elf-read: %w", err)
+			}
+		}
+		img, err = s.image(path, bin)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	logger.Printf("%d: executed %s (%d regions)\n", pid, path, len(img.regions))
+	return img, img.regions, img.ids, nil
+}
+
+// realpath returns the absolute path of a file with all symbolic links
+// resolved, or the path itself if that fails.
+func realpath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return abs
+	}
+	return real
+}
@@ -2,45 +2,259 @@ package perforator
 
 import (
 	"fmt"
+	"math"
 	"sort"
 	"time"
 )
 
 // A Result represents a single event, marked by Label, and the counter value
-// returned by the perf monitor.
+// returned by the perf monitor. Value is scaled to account for multiplexing:
+// Raw is the value that was counted while the event was running on the PMU,
+// and Enabled and Running are the times during which the event was enabled
+// and actually running. Value is Raw multiplied by Scale.
 type Result struct {
-	Label string
-	Value uint64
+	Label   string        `json:"label"`
+	Value   uint64        `json:"value"`
+	Raw     uint64        `json:"raw"`
+	Enabled time.Duration `json:"enabled"`
+	Running time.Duration `json:"running"`
+}
+
+// Counted reports whether the event was counted. An event that was enabled
+// but never running, because other events had the counters of the PMU the
+// whole time, was not counted and its value is meaningless.
+func (r Result) Counted() bool {
+	return r.Running > 0 || r.Enabled == 0
+}
+
+// Scale returns the factor that the raw count was scaled by to account for
+// multiplexing, which is the ratio of the time that the event was enabled to
+// the time it was running. It is 1 if the event was not multiplexed and 0 if
+// it was not counted.
+func (r Result) Scale() float64 {
+	if r.Running == r.Enabled {
+		return 1
+	} else if r.Running == 0 {
+		return 0
+	}
+	return float64(r.Enabled) / float64(r.Running)
+}
+
+// DefaultMinRunning is the fraction of the time that an event must have been
+// running for its value to be shown without a '?' by default. Below it, more
+// than half of the value is extrapolated by multiplexing.
+const DefaultMinRunning = 0.5
+
+// Scaling configures how tables show the scaling of results. Values of
+// events that were not counted are always shown as "<not counted>".
+type Scaling struct {
+	// Show adds a column with the scale factor after each event.
+	Show bool
+	// MinRunning marks the values of events that were running for less
+	// than this fraction of the time that they were enabled as unreliable,
+	// with a '?' after the value. Zero marks no value.
+	MinRunning float64
+}
+
+// header returns the columns of an event in the header of a table.
+func (s Scaling) header(label string) []string {
+	if s.Show {
+		return []string{label, label + " scale"}
+	}
+	return []string{label}
+}
+
+// cells returns the columns of a result in a row of a table.
+func (s Scaling) cells(r Result) []string {
+	value, scale := "<not counted>", "-"
+	if r.Counted() {
+		value = fmt.Sprintf("%d", r.Value)
+		if r.Enabled > 0 && float64(r.Running) < s.MinRunning*float64(r.Enabled) {
+			value += "?"
+		}
+		scale = fmt.Sprintf("%.2f", r.Scale())
+	}
+	if s.Show {
+		return []string{value, scale}
+	}
+	return []string{value}
+}
+
+// add adds the counts and times of another result for the same event.
+func (r *Result) add(o Result) {
+	r.Value += o.Value
+	r.Raw += o.Raw
+	r.Enabled += o.Enabled
+	r.Running += o.Running
 }
 
 // Metrics stores a set of results and the time elapsed while they were
-// profiling.
+// profiling, along with any derived metrics computed from them.
 type Metrics struct {
 	Results []Result
 	Elapsed time.Duration
+	Derived []Derived
+}
+
+// A Derived is the value of a metric computed from the results with a
+// formula (see Formula).
+type Derived struct {
+	Label string
+	Expr  string
+	Value float64
+}
+
+// derive computes the derived metrics given by 'formulas'.
+func (m Metrics) derive(formulas []*Formula) Metrics {
+	if len(formulas) == 0 {
+		return m
+	}
+	m.Derived = make([]Derived, len(formulas))
+	for i, f := range formulas {
+		m.Derived[i] = Derived{
+			Label: f.Name,
+			Expr:  f.Expr,
+			Value: f.Eval(m),
+		}
+	}
+	return m
+}
+
+// rederive computes the derived metrics again after the results have
+// changed, for example because they were aggregated.
+func (m Metrics) rederive() Metrics {
+	if len(m.Derived) == 0 {
+		return m
+	}
+	derived := make([]Derived, len(m.Derived))
+	for i, d := range m.Derived {
+		derived[i] = d
+		f, err := NewFormula(d.Label, d.Expr)
+		if err != nil {
+			derived[i].Value = math.NaN()
+			continue
+		}
+		derived[i].Value = f.Eval(m)
+	}
+	m.Derived = derived
+	return m
+}
+
+// sub returns the metrics collected since the snapshot 'base' was taken from
+// the same profiler.
+func (m Metrics) sub(base Metrics) Metrics {
+	if len(base.Results) == 0 {
+		return m
+	}
+	d := Metrics{
+		Results: make([]Result, len(m.Results)),
+		Elapsed: m.Elapsed - base.Elapsed,
+		Derived: m.Derived,
+	}
+	for i, r := range m.Results {
+		d.Results[i] = r
+		if i >= len(base.Results) {
+			continue
+		}
+		b := base.Results[i]
+		// scaled counts are estimates that may decrease slightly
+		if r.Value >= b.Value {
+			d.Results[i].Value -= b.Value
+		} else {
+			d.Results[i].Value = 0
+		}
+		if r.Raw >= b.Raw {
+			d.Results[i].Raw -= b.Raw
+		} else {
+			d.Results[i].Raw = 0
+		}
+		d.Results[i].Enabled -= b.Enabled
+		d.Results[i].Running -= b.Running
+		if d.Results[i].Enabled > 0 {
+			// scale the count with the times of the interval itself,
+			// since the event may have been multiplexed differently
+			// before it
+			d.Results[i] = scaled(r.Label, d.Results[i].Raw, d.Results[i].Enabled, d.Results[i].Running)
+		}
+	}
+	return d
+}
+
+// add returns the sum of two metrics with the same events. The derived
+// metrics are not computed again (see rederive).
+func (m Metrics) add(o Metrics) Metrics {
+	sum := Metrics{
+		Results: append([]Result(nil), m.Results...),
+		Elapsed: m.Elapsed + o.Elapsed,
+		Derived: m.Derived,
+	}
+	if len(sum.Derived) == 0 {
+		sum.Derived = o.Derived
+	}
+	if len(sum.Results) == 0 {
+		sum.Results = append(sum.Results, o.Results...)
+		return sum
+	}
+	for i := range sum.Results {
+		if i < len(o.Results) {
+			sum.Results[i].add(o.Results[i])
+		}
+	}
+	return sum
 }
 
 // NamedMetrics associates a metrics structure with a name. This is useful for
-// associated metrics structures with regions.
+// associated metrics structures with regions. The index of the run of the
+// target (see Config.Repeat), and the process ID, thread ID and thread name
+// (comm) of the thread that executed the region are included as well, along with the recursion depth of the invocation (0 unless every
+// recursive invocation is reported) and the names of the regions that the
+// thread was executing when the invocation began, outermost first.
 type NamedMetrics struct {
 	Metrics
-	Name string
+	Name  string
+	Run   int
+	Pid   int
+	Tid   int
+	Comm  string
+	Depth int
+	Stack []string
 }
 
 // WriteTo pretty-prints the metrics and writes the result to a MetricsWriter.
+// Values that were running for less than DefaultMinRunning of the time are
+// marked as unreliable.
 func (m NamedMetrics) WriteTo(table MetricsWriter) {
-	table.SetHeader([]string{"Event", fmt.Sprintf("Count (%s)", m.Name)})
+	m.WriteScaled(table, Scaling{MinRunning: DefaultMinRunning})
+}
+
+// WriteScaled is like WriteTo, and shows the scaling of the results as
+// configured by 's'.
+func (m NamedMetrics) WriteScaled(table MetricsWriter, s Scaling) {
+	header := []string{"Event", fmt.Sprintf("Count (%s)", m.Name)}
+	if s.Show {
+		header = append(header, "Scale")
+	}
+	table.SetHeader(header)
 
+	pad := func(row []string) []string {
+		if s.Show {
+			row = append(row, "")
+		}
+		return row
+	}
 	for _, r := range m.Results {
-		table.Append([]string{
-			r.Label,
-			fmt.Sprintf("%d", r.Value),
-		})
+		table.Append(append([]string{r.Label}, s.cells(r)...))
 	}
-	table.Append([]string{
+	table.Append(pad([]string{
 		"time-elapsed",
 		fmt.Sprintf("%s", m.Elapsed),
-	})
+	}))
+	for _, d := range m.Derived {
+		table.Append(pad([]string{
+			d.Label,
+			formatDerived(d.Value),
+		}))
+	}
 
 	table.Render()
 }
@@ -48,35 +262,224 @@ func (m NamedMetrics) WriteTo(table MetricsWriter) {
 // TotalMetrics is a list of metrics and the region they are associated with.
 type TotalMetrics []NamedMetrics
 
+// GroupBy specifies how invocations of regions are aggregated.
+type GroupBy int
+
+const (
+	// GroupNone keeps every invocation separate.
+	GroupNone GroupBy = iota
+	// GroupRegion aggregates all invocations of a region.
+	GroupRegion
+	// GroupThread aggregates the invocations of a region by each thread.
+	GroupThread
+	// GroupProcess aggregates the invocations of a region by each process.
+	GroupProcess
+)
+
+// Recursion selects which invocations of a recursive region are reported.
+type Recursion int
+
+const (
+	// RecursionOuter only reports the outermost invocation, which includes
+	// all of the recursive invocations.
+	RecursionOuter Recursion = iota
+	// RecursionAll reports every invocation. The metrics of an invocation
+	// include those of the invocations nested in it.
+	RecursionAll
+)
+
+// Counters selects when the counters of a thread are running.
+type Counters int
+
+const (
+	// CountersRegion only runs the counters while the thread is in a
+	// region. They are reset when the thread enters its outermost region,
+	// and nested regions are measured from snapshots.
+	CountersRegion Counters = iota
+	// CountersAlways runs the counters from the moment the thread is first
+	// seen until it exits, and measures every region as the difference
+	// between snapshots taken when it is entered and exited. This saves
+	// the system calls that start and stop the counters at each outermost
+	// region.
+	CountersAlways
+)
+
+// ParseCounters converts "region" or "always" to a Counters.
+func ParseCounters(s string) (Counters, error) {
+	switch s {
+	case "", "region":
+		return CountersRegion, nil
+	case "always":
+		return CountersAlways, nil
+	}
+	return CountersRegion, fmt.Errorf("invalid counters mode: %s", s)
+}
+
+// Scope selects what the counters of a region count.
+type Scope int
+
+const (
+	// ScopeThread counts the thread that entered the region.
+	ScopeThread Scope = iota
+	// ScopeProcess counts every thread of the target, including the
+	// threads and processes that it creates. Entering or exiting a region
+	// on any thread starts or stops counting on all of them.
+	ScopeProcess
+)
+
+// ParseScope converts "thread" or "process" to a Scope.
+func ParseScope(s string) (Scope, error) {
+	switch s {
+	case "", "thread":
+		return ScopeThread, nil
+	case "process":
+		return ScopeProcess, nil
+	}
+	return ScopeThread, fmt.Errorf("invalid scope: %s", s)
+}
+
+// ParseRecursion converts "outer" or "all" to a Recursion.
+func ParseRecursion(s string) (Recursion, error) {
+	switch s {
+	case "", "outer":
+		return RecursionOuter, nil
+	case "all":
+		return RecursionAll, nil
+	}
+	return RecursionOuter, fmt.Errorf("invalid recursion mode: %s", s)
+}
+
+// ParseGroupBy converts one of "none", "region", "thread" or "process" to a
+// GroupBy.
+func ParseGroupBy(s string) (GroupBy, error) {
+	switch s {
+	case "", "none":
+		return GroupNone, nil
+	case "region":
+		return GroupRegion, nil
+	case "thread":
+		return GroupThread, nil
+	case "process":
+		return GroupProcess, nil
+	}
+	return GroupNone, fmt.Errorf("invalid grouping: %s", s)
+}
+
+// split renames every invocation after the group that it belongs to, without
+// aggregating them. Thread groups are named 'region [tid comm]' and process
+// groups 'region [pid comm]', where the process is named after its main
+// thread if that thread executed the region.
+func (t TotalMetrics) split(by GroupBy) TotalMetrics {
+	if by == GroupNone {
+		return t
+	}
+
+	type key struct {
+		name string
+		id   int
+	}
+	comms := make(map[key]string)
+	for _, m := range t {
+		switch by {
+		case GroupThread:
+			k := key{m.Name, m.Tid}
+			if _, ok := comms[k]; !ok {
+				comms[k] = m.Comm
+			}
+		case GroupProcess:
+			k := key{m.Name, m.Pid}
+			if _, ok := comms[k]; !ok || m.Tid == m.Pid {
+				comms[k] = m.Comm
+			}
+		}
+	}
+
+	split := make(TotalMetrics, len(t))
+	for i, m := range t {
+		switch by {
+		case GroupRegion:
+			m.Pid, m.Tid, m.Comm = 0, 0, ""
+		case GroupThread:
+			m.Comm = comms[key{m.Name, m.Tid}]
+			m.Name = fmt.Sprintf("%s [%d %s]", m.Name, m.Tid, m.Comm)
+		case GroupProcess:
+			m.Tid = 0
+			m.Comm = comms[key{m.Name, m.Pid}]
+			m.Name = fmt.Sprintf("%s [%d %s]", m.Name, m.Pid, m.Comm)
+		}
+		split[i] = m
+	}
+	return split
+}
+
+// Group aggregates the invocations of each region according to 'by'. The
+// results and elapsed times of all invocations in a group are summed, and
+// groups are listed in the order in which they first appear.
+func (t TotalMetrics) Group(by GroupBy) TotalMetrics {
+	if by == GroupNone {
+		return t
+	}
+
+	grouped := make(TotalMetrics, 0)
+	index := make(map[string]int)
+	for _, m := range t.split(by) {
+		i, ok := index[m.Name]
+		if !ok {
+			index[m.Name] = len(grouped)
+			m.Results = append([]Result(nil), m.Results...)
+			grouped = append(grouped, m)
+			continue
+		}
+		g := &grouped[i]
+		for j := range g.Results {
+			if j < len(m.Results) {
+				g.Results[j].add(m.Results[j])
+			}
+		}
+		g.Elapsed += m.Elapsed
+	}
+	for i := range grouped {
+		grouped[i].Metrics = grouped[i].Metrics.rederive()
+	}
+	return grouped
+}
+
+// WriteTo pretty-prints the metrics and writes the result to a MetricsWriter,
+// with one row for each invocation. Values that were running for less than
+// DefaultMinRunning of the time are marked as unreliable.
 func (t TotalMetrics) WriteTo(table MetricsWriter) {
+	t.WriteScaled(table, Scaling{MinRunning: DefaultMinRunning})
+}
+
+// WriteScaled is like WriteTo, and shows the scaling of the results as
+// configured by 's'.
+func (t TotalMetrics) WriteScaled(table MetricsWriter, s Scaling) {
 	header := []string{"region"}
 	for _, m := range t {
 		for _, result := range m.Results {
-			header = append(header, result.Label)
+			header = append(header, s.header(result.Label)...)
 		}
 		break
 	}
 	header = append(header, "time-elapsed")
-
-	table.SetHeader(header)
-
-	type kv struct {
-		Key   string
-		Value Metrics
+	for _, m := range t {
+		for _, d := range m.Derived {
+			header = append(header, d.Label)
+		}
+		break
 	}
 
-	var ss []kv
-	for _, v := range t {
-		ss = append(ss, kv{v.Name, v.Metrics})
-	}
+	table.SetHeader(header)
 
-	for _, kv := range ss {
-		row := []string{kv.Key}
-		m := kv.Value
+	for _, m := range t {
+		row := []string{m.Name}
 		for _, result := range m.Results {
-			row = append(row, fmt.Sprintf("%d", result.Value))
+			row = append(row, s.cells(result)...)
 		}
 		row = append(row, fmt.Sprintf("%s", m.Elapsed))
+		for _, d := range m.Derived {
+			row = append(row, formatDerived(d.Value))
+		}
 		table.Append(row)
 	}
 
@@ -85,57 +488,62 @@ func (t TotalMetrics) WriteTo(table MetricsWriter) {
 
 // WriteToSorted pretty-prints the metrics and writes the result to a MetricsWriter.
 // The sortKey and reverse parameters configure the table arrangement: which
-// entry to sort by and whether the sort should be in reverse order.
+// entry to sort by and whether the sort should be in reverse order. The key
+// may be an event, "time-elapsed" or a derived metric.
 func (t TotalMetrics) WriteToSorted(table MetricsWriter, sortKey string, reverse bool) {
+	t.Sorted(sortKey, reverse).WriteTo(table)
+}
+
+// Sorted returns a copy of the metrics sorted by the given key in decreasing
+// order, or increasing order if 'reverse' is set (see WriteToSorted).
+func (t TotalMetrics) Sorted(sortKey string, reverse bool) TotalMetrics {
 	var sortIdx int
-	header := []string{"region"}
+	derivedIdx := -1
 	for _, m := range t {
 		for i, result := range m.Results {
 			if result.Label == sortKey {
 				sortIdx = i
 			}
-			header = append(header, result.Label)
+		}
+		for i, d := range m.Derived {
+			if d.Label == sortKey {
+				derivedIdx = i
+			}
 		}
 		break
 	}
-	header = append(header, "time-elapsed")
-
-	table.SetHeader(header)
-
-	type kv struct {
-		Key   string
-		Value Metrics
-	}
-
-	var ss []kv
-	for _, v := range t {
-		ss = append(ss, kv{v.Name, v.Metrics})
-	}
 
+	ss := append(TotalMetrics(nil), t...)
 	sort.Slice(ss, func(i, j int) bool {
+		if derivedIdx >= 0 {
+			vali := ss[i].Derived[derivedIdx].Value
+			valj := ss[j].Derived[derivedIdx].Value
+			if reverse {
+				return lessDerived(vali, valj)
+			}
+			return lessDerived(valj, vali)
+		}
 		if sortKey == "time-elapsed" {
-			vali := ss[i].Value.Elapsed
-			valj := ss[j].Value.Elapsed
+			vali := ss[i].Elapsed
+			valj := ss[j].Elapsed
 			if reverse {
 				return vali < valj
 			}
 			return valj < vali
 		}
 		if reverse {
-			return ss[i].Value.Results[sortIdx].Value < ss[j].Value.Results[sortIdx].Value
+			return ss[i].Results[sortIdx].Value < ss[j].Results[sortIdx].Value
 		}
-		return ss[i].Value.Results[sortIdx].Value > ss[j].Value.Results[sortIdx].Value
+		return ss[i].Results[sortIdx].Value > ss[j].Results[sortIdx].Value
 	})
+	return ss
+}
 
-	for _, kv := range ss {
-		row := []string{kv.Key}
-		m := kv.Value
-		for _, result := range m.Results {
-			row = append(row, fmt.Sprintf("%d", result.Value))
-		}
-		row = append(row, fmt.Sprintf("%s", m.Elapsed))
-		table.Append(row)
+// lessDerived orders the values of derived metrics, with NaN (for example
+// after a division by zero) before every other value.
+func lessDerived(a, b float64) bool {
+	if math.IsNaN(a) {
+		return !math.IsNaN(b)
 	}
-
-	table.Render()
+	return !math.IsNaN(b) && a < b
 }
@@ -0,0 +1,136 @@
+package perforator
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+// named returns the metrics of an invocation of the region 'name', which
+// the tests use as fixtures.
+func named(name string, elapsed time.Duration, results ...Result) NamedMetrics {
+	return NamedMetrics{
+		Metrics: Metrics{Results: results, Elapsed: elapsed},
+		Name:    name,
+	}
+}
+
+// count returns a result of the event 'label'.
+func count(label string, v uint64) Result {
+	return Result{Label: label, Value: v}
+}
+
+// on returns the metrics as collected on thread 'tid' of process 'pid'.
+func (nm NamedMetrics) on(pid, tid int, comm string) NamedMetrics {
+	nm.Pid, nm.Tid, nm.Comm = pid, tid, comm
+	return nm
+}
+
+// within returns the metrics as collected inside the regions of 'stack'.
+func (nm NamedMetrics) within(stack ...string) NamedMetrics {
+	nm.Stack = stack
+	return nm
+}
+
+func TestGroup(t *testing.T) {
+	total := TotalMetrics{
+		named("a", time.Second, count("instructions", 1)).on(10, 11, "worker"),
+		named("a", time.Second, count("instructions", 2)).on(10, 10, "main"),
+		named("a", time.Second, count("instructions", 4)).on(10, 11, "worker"),
+		named("b", time.Second, count("instructions", 8)).on(20, 20, "child"),
+	}
+
+	check := func(by GroupBy, names []string, values []uint64) {
+		t.Helper()
+		g := total.Group(by)
+		if len(g) != len(names) {
+			t.Fatalf("%v: unexpected groups: %+v", by, g)
+		}
+		for i := range g {
+			if g[i].Name != names[i] || g[i].Results[0].Value != values[i] {
+				t.Errorf("%v: group %d: got %s=%d, want %s=%d", by, i, g[i].Name, g[i].Results[0].Value, names[i], values[i])
+			}
+		}
+	}
+
+	check(GroupRegion, []string{"a", "b"}, []uint64{7, 8})
+	check(GroupThread, []string{"a [11 worker]", "a [10 main]", "b [20 child]"}, []uint64{5, 2, 8})
+	check(GroupProcess, []string{"a [10 main]", "b [20 child]"}, []uint64{7, 8})
+
+	if total[0].Results[0].Value != 1 {
+		t.Errorf("grouping modified the original metrics")
+	}
+	if g := total.Group(GroupRegion); g[0].Elapsed != 3*time.Second {
+		t.Errorf("unexpected elapsed time: %v", g[0].Elapsed)
+	}
+}
+
+func TestSub(t *testing.T) {
+	m := Metrics{Results: []Result{{Label: "instructions", Value: 10}, {Label: "cycles", Value: 4}}, Elapsed: 3 * time.Second}
+	base := Metrics{Results: []Result{{Label: "instructions", Value: 7}, {Label: "cycles", Value: 5}}, Elapsed: time.Second}
+
+	d := m.sub(base)
+	if d.Results[0].Value != 3 || d.Elapsed != 2*time.Second {
+		t.Errorf("unexpected difference: %+v", d)
+	}
+	// scaled counts may decrease, which must not wrap around
+	if d.Results[1].Value != 0 {
+		t.Errorf("unexpected clamped difference: %+v", d.Results[1])
+	}
+	if m.sub(Metrics{}).Results[0].Value != 10 {
+		t.Errorf("empty base should not change the metrics")
+	}
+
+	// the difference is scaled with the times of the interval: the event
+	// was multiplexed before the snapshot but not after it
+	before := Metrics{Results: []Result{scaled("instructions", 50, 100, 50)}}
+	after := Metrics{Results: []Result{scaled("instructions", 80, 130, 80)}}
+	if r := after.sub(before).Results[0]; r.Value != 30 || r.Raw != 30 || r.Scale() != 1 {
+		t.Errorf("unexpected rescaled difference: %+v", r)
+	}
+}
+
+func TestScaling(t *testing.T) {
+	full := scaled("instructions", 100, 10, 10)
+	half := scaled("cpu-cycles", 100, 10, 5)
+	none := scaled("cache-misses", 100, 10, 0)
+	if full.Value != 100 || full.Scale() != 1 || !full.Counted() {
+		t.Errorf("unexpected result: %+v", full)
+	}
+	if half.Value != 200 || half.Scale() != 2 || !half.Counted() {
+		t.Errorf("unexpected result: %+v", half)
+	}
+	if none.Value != 0 || none.Scale() != 0 || none.Counted() {
+		t.Errorf("unexpected result: %+v", none)
+	}
+
+	ipc, err := ParseFormula("ipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Metrics{Results: []Result{full, none}}
+	if v := ipc.Eval(m); !math.IsNaN(v) {
+		t.Errorf("a metric of an event that was not counted should be NaN, got %v", v)
+	}
+
+	var buf bytes.Buffer
+	total := TotalMetrics{{Metrics: Metrics{Results: []Result{full, half, none}}, Name: "f"}}
+	total.WriteScaled(NewCSVWriter(&buf), Scaling{Show: true, MinRunning: 0.6})
+	want := "region,instructions,instructions scale,cpu-cycles,cpu-cycles scale,cache-misses,cache-misses scale,time-elapsed\n" +
+		"f,100,1.00,200?,2.00,<not counted>,-,0s\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	// by default a value that was mostly extrapolated is marked
+	buf.Reset()
+	low := scaled("branch-misses", 10, 10, 2)
+	total = TotalMetrics{{Metrics: Metrics{Results: []Result{full, half, low}}, Name: "f"}}
+	total.WriteTo(NewCSVWriter(&buf))
+	want = "region,instructions,cpu-cycles,branch-misses,time-elapsed\n" +
+		"f,100,200,50?,0s\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
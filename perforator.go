@@ -1,10 +1,8 @@
 package perforator
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"os/exec"
-	"runtime"
 	"strings"
 
 	"github.com/zyedidia/perf"
@@ -20,34 +18,155 @@ type Events struct {
 	Groups [][]perf.Configurator
 }
 
-// Run executes the given command with tracing for certain events enabled. A
-// structure with all perf metrics is returned.
-func Run(target string, args []string,
-	regionNames []string,
-	events Events,
-	attropts perf.Options,
-	immediate func() MetricsWriter,
-	ignoreMissingRegions bool,
-	rangeInnerDelimiter string,
-	excludeClones bool) (TotalMetrics, error) {
-
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-
-	path, err := exec.LookPath(target)
-	if err != nil {
-		return TotalMetrics{}, fmt.Errorf("lookpath: %w", err)
+// Labels returns the labels of all events, in the order that they appear in
+// the results.
+func (e Events) Labels() []string {
+	var labels []string
+	add := func(c perf.Configurator) {
+		var attr perf.Attr
+		c.Configure(&attr)
+		labels = append(labels, attr.Label)
+	}
+	for _, c := range e.Base {
+		add(c)
 	}
+	for _, group := range e.Groups {
+		for _, c := range group {
+			add(c)
+		}
+	}
+	return labels
+}
 
-	f, err := os.Open(path)
-	if err != nil {
-		return TotalMetrics{}, fmt.Errorf("open: %w", err)
+// Add adds the events with the given names to the base events, unless they
+// are already measured. An alias is measured if the event that it names is.
+func (e *Events) Add(names ...string) error {
+	have := make(map[string]bool)
+	for _, l := range e.Labels() {
+		have[l] = true
 	}
+	for _, name := range names {
+		if have[name] {
+			continue
+		}
+		c, err := NameToConfig(name)
+		if err != nil {
+			return err
+		}
+		if l := label(c, name); !have[l] {
+			e.Base = append(e.Base, c)
+			have[l] = true
+		}
+	}
+	return nil
+}
+
+// Config specifies which program to trace and what should be measured.
+type Config struct {
+	// Target is the command to execute, with arguments Args. It is ignored
+	// if Pid is set.
+	Target string
+	Args   []string
+	// Pid is the process ID of an already running process to attach to
+	// instead of executing a command.
+	Pid int
+
+	// Regions is the list of regions to profile. A region is either a
+	// function name or a range written as 'start-end' (see ParseRegion).
+	Regions []string
+	// RegionNames are the names that the regions are reported with, in the
+	// same order as Regions. A region without a name (an empty string or
+	// past the end of the list) is reported with the region itself.
+	RegionNames []string
+	// Events is the set of events to measure in each region.
+	Events Events
+	// Options configures every perf event.
+	Options perf.Options
+	// Formulas are derived metrics that are computed for every invocation.
+	// The events that they use must be measured (see Events.Add).
+	Formulas []*Formula
+
+	// Reporter receives the results as they are collected. It may be nil.
+	Reporter Reporter
+
+	// IgnoreMissingRegions continues execution even if a region cannot be
+	// found.
+	IgnoreMissingRegions bool
+	// RangeInnerDelimiter separates the start and end of a range region. It
+	// defaults to "-".
+	RangeInnerDelimiter string
+	// ExcludeClones excludes compiler-generated clones when looking up
+	// functions.
+	ExcludeClones bool
+
+	// Recursion selects whether only the outermost invocation of a
+	// recursive region is reported, or every invocation.
+	Recursion Recursion
+	// Counters selects whether the counters of a thread only run while it
+	// is in a region, or for as long as it is traced.
+	Counters Counters
+	// Scope selects whether a region counts the thread that entered it, or
+	// every thread and child process of the target.
+	Scope Scope
+
+	// FollowExec keeps tracing processes after they call execve, and
+	// resolves the regions again in each new program. This is useful when
+	// the target is started through a wrapper such as env or a shell
+	// script. Unless Binary is set, regions that are not found in a program
+	// are ignored.
+	FollowExec bool
+	// Binary limits the programs that regions are resolved in to those
+	// whose executable matches. A name without a slash matches the base name
+	// of the executable and a path matches the executable itself. It is only
+	// used with FollowExec.
+	Binary string
+
+	// Repeat is the number of times the command is executed (at least
+	// once). The metrics of every execution are returned together, which is
+	// useful for computing statistics with TotalMetrics.Stats. Repeat must
+	// not be used when attaching to a process.
+	Repeat int
+}
 
-	bin, err := bininfo.Read(f, f.Name())
+// regionName returns the name that the region at index i of Regions is
+// reported with.
+func (cfg *Config) regionName(i int) string {
+	if i < len(cfg.RegionNames) && cfg.RegionNames[i] != "" {
+		return cfg.RegionNames[i]
+	}
+	return cfg.Regions[i]
+}
+
+// Run traces the program described by the configuration until it finishes
+// and returns a structure with all perf metrics. It is a convenience wrapper
+// around a Session.
+func Run(cfg Config) (TotalMetrics, error) {
+	return RunContext(context.Background(), cfg)
+}
+
+// RunContext is like Run but stops tracing when the context is done. The
+// target is then detached and left running, and the metrics collected so far
+// are returned along with the context's error.
+func RunContext(ctx context.Context, cfg Config) (TotalMetrics, error) {
+	s := NewSession(cfg)
+	err := s.StartContext(ctx)
 	if err != nil {
-		return TotalMetrics{}, fmt.Errorf("elf-read: %w", err)
+		return TotalMetrics{}, err
 	}
+	defer s.Close()
+	return s.Wait()
+}
+
+// resolveRegions converts the region names into regions in the binary. Each
+// region is returned along with the index of the name that it came from,
+// since one name may resolve to multiple regions (for example if a function
+// has been inlined). If 'lib' is empty the binary is the executable and
+// regions in shared libraries are skipped, otherwise only the regions in the
+// library at path 'lib' are resolved. If 'strict' is false, regions that
+// cannot be found are skipped, which is used for programs that are only
+// executed on the way to the program of interest when following exec.
+func (s *Session) resolveRegions(bin *bininfo.BinFile, lib string, strict bool) ([]utrace.Region, []int, error) {
+	cfg := &s.cfg
 
 	var regions []utrace.Region
 	var regionIds []int
@@ -57,18 +176,26 @@ func Run(target string, args []string,
 		regionIds = append(regionIds, id)
 	}
 
-	for i, name := range regionNames {
-		if strings.Contains(name, "-") {
-			reg, err := ParseRegion(name, bin, rangeInnerDelimiter)
-			if err != nil {
-				return TotalMetrics{}, fmt.Errorf("region-parse: %w", err)
+	for i, spec := range cfg.Regions {
+		specLib, name := splitLibrary(spec)
+		if (lib == "" && specLib != "") || (lib != "" && !matchLibrary(specLib, lib)) {
+			continue
+		}
+
+		if strings.Contains(name, cfg.RangeInnerDelimiter) {
+			reg, err := ParseRegion(name, bin, cfg.RangeInnerDelimiter)
+			if err != nil && !strict {
+				logger.Printf("%s: %s\n", name, err)
+				continue
+			} else if err != nil {
+				return nil, nil, fmt.Errorf("region-parse: %w", err)
 			}
 
 			logger.Printf("%s: 0x%x-0x%x\n", name, reg.StartAddr, reg.EndAddr)
 
 			addregion(reg, i)
 		} else {
-			fnpc, fnerr := bin.FuncToPC(name, excludeClones)
+			fnpc, fnerr := bin.FuncToPC(name, cfg.ExcludeClones)
 
 			if fnerr == nil {
 				logger.Printf("%s: 0x%x\n", name, fnpc)
@@ -77,17 +204,20 @@ func Run(target string, args []string,
 				}, i)
 			}
 
-			inlinings, err := bin.InlinedFuncToPCs(name, excludeClones)
+			inlinings, err := bin.InlinedFuncToPCs(name, cfg.ExcludeClones)
 
 			if len(inlinings) == 0 {
 				logger.Printf("%s not inlined (error: %s)\n", name, err)
 			}
 
 			if err != nil {
-				if fnerr != nil {
-					if err != nil && !ignoreMissingRegions {
-						return TotalMetrics{}, fmt.Errorf("func-lookup: %w, inlined-func-lookup: %s", fnerr, err)
+				if fnerr != nil && !strict {
+					logger.Printf("%s not found, ignoring\n", name)
+				} else if fnerr != nil {
+					if err != nil && !cfg.IgnoreMissingRegions {
+						return nil, nil, fmt.Errorf("func-lookup: %w, inlined-func-lookup: %s", fnerr, err)
 					}
+					s.report.Diagnostic(fmt.Sprintf("region %s not found, ignoring", spec))
 				}
 
 				continue
@@ -103,108 +233,22 @@ func Run(target string, args []string,
 		}
 	}
 
-	prog, pid, err := utrace.NewProgram(bin, target, args, regions)
-	if err != nil {
-		return TotalMetrics{}, err
-	}
-
-	fa := &perf.Attr{
-		CountFormat: perf.CountFormat{
-			Enabled: true,
-			Running: true,
-		},
-		Options: attropts,
-	}
-	fa.Options.Disabled = true
-
-	base := make([]*perf.Attr, len(events.Base))
-	for i, c := range events.Base {
-		attr := *fa
-		c.Configure(&attr)
-		base[i] = &attr
-	}
-	groups := make([][]*perf.Attr, len(events.Groups))
-	for i, group := range events.Groups {
-		for _, c := range group {
-			attr := *fa
-			c.Configure(&attr)
-			groups[i] = append(groups[i], &attr)
-		}
-	}
+	return regions, regionIds, nil
+}
 
-	total := make(TotalMetrics, 0)
-	ptable := make(map[int][]Profiler)
-	ptable[pid], err = makeProfilers(pid, len(regions), base, groups, fa)
+// makeProfiler opens a profiler for the thread 'pid' that counts the base
+// events and every group of events.
+func makeProfiler(pid int, attrs []*perf.Attr, groups [][]*perf.Attr) (Profiler, error) {
+	mprof, err := NewMultiProfiler(attrs, pid, perf.AnyCPU)
 	if err != nil {
-		return total, err
-	}
-
-	for {
-		var ws utrace.Status
-
-		p, evs, err := prog.Wait(&ws)
-		if err == utrace.ErrFinishedTrace {
-			break
-		}
-		if err != nil {
-			return total, fmt.Errorf("wait: %w", err)
-		}
-
-		profilers, ok := ptable[p.Pid()]
-		if !ok {
-			ptable[p.Pid()], err = makeProfilers(p.Pid(), len(regions), base, groups, fa)
-			if err != nil {
-				return total, err
-			}
-		}
-
-		for _, ev := range evs {
-			switch ev.State {
-			case utrace.RegionStart:
-				logger.Printf("%d: Profiler %d enabled\n", p.Pid(), ev.Id)
-				profilers[ev.Id].Disable()
-				profilers[ev.Id].Reset()
-				profilers[ev.Id].Enable()
-			case utrace.RegionEnd:
-				profilers[ev.Id].Disable()
-				logger.Printf("%d: Profiler %d disabled\n", p.Pid(), ev.Id)
-				nm := NamedMetrics{
-					Metrics: profilers[ev.Id].Metrics(),
-					Name:    regionNames[regionIds[ev.Id]],
-				}
-				total = append(total, nm)
-				writer := immediate()
-				if writer != nil {
-					nm.WriteTo(writer)
-				}
-			}
-		}
-
-		err = prog.Continue(p, ws)
-		if err != nil {
-			return total, fmt.Errorf("trace-continue: %w", err)
-		}
+		return nil, fmt.Errorf("profiler: %w", err)
 	}
-
-	return total, nil
-}
-
-func makeProfilers(pid, n int, attrs []*perf.Attr, groups [][]*perf.Attr, fa *perf.Attr) ([]Profiler, error) {
-	profilers := make([]Profiler, n)
-	for i := 0; i < n; i++ {
-		mprof, err := NewMultiProfiler(attrs, pid, perf.AnyCPU)
+	for _, gattrs := range groups {
+		gprof, err := NewGroupProfiler(gattrs, pid, perf.AnyCPU)
 		if err != nil {
 			return nil, fmt.Errorf("profiler: %w", err)
 		}
-		for _, gattrs := range groups {
-			gprof, err := NewGroupProfiler(gattrs, pid, perf.AnyCPU)
-			if err != nil {
-				return nil, fmt.Errorf("profiler: %w", err)
-			}
-			mprof.profilers = append(mprof.profilers, gprof)
-		}
-
-		profilers[i] = mprof
+		mprof.profilers = append(mprof.profilers, gprof)
 	}
-	return profilers, nil
+	return mprof, nil
 }
@@ -1,9 +1,12 @@
 package perforator
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os/exec"
-	"runtime"
 	"testing"
+	"time"
 
 	"github.com/zyedidia/perf"
 )
@@ -45,6 +48,12 @@ func buildGo(src, out string, dwarf, pie bool) error {
 	return err
 }
 
+func buildC(src, out string, flags ...string) error {
+	cmd := exec.Command("gcc", append([]string{"-g", "-O0", "-pthread", "-o", out, src}, flags...)...)
+	_, err := cmd.Output()
+	return err
+}
+
 func check(target string, regions []string, events []perf.Configurator, expected TotalMetrics, t *testing.T) {
 	evs := Events{
 		Base: events,
@@ -53,7 +62,12 @@ func check(target string, regions []string, events []perf.Configurator, expected
 		ExcludeKernel:     true,
 		ExcludeHypervisor: true,
 	}
-	total, err := Run(target, []string{}, regions, evs, opts, func() MetricsWriter { return nil }, false)
+	total, err := Run(Config{
+		Target:  target,
+		Regions: regions,
+		Events:  evs,
+		Options: opts,
+	})
 	must(err, t)
 
 	for i, v := range total {
@@ -73,8 +87,6 @@ func check(target string, regions []string, events []perf.Configurator, expected
 // it also tests multithreading support, since the Go runtime automatically
 // spawns threads).
 func TestSingleRegion(t *testing.T) {
-	runtime.LockOSThread()
-
 	must(buildGo("test/sum.go", "test/sum", true, true), t)
 	regions := []string{
 		"main.sum",
@@ -107,3 +119,401 @@ func TestSingleRegion(t *testing.T) {
 	}
 	check("test/sum", regions, events, expected, t)
 }
+
+// Tests that the process scope counts a thread that never enters a region,
+// both in a launched process and in one that is attached to.
+func TestProcessScope(t *testing.T) {
+	if err := buildC("test/worker.c", "test/worker"); err != nil {
+		t.Skip("cannot build test/worker.c:", err)
+	}
+	taskClock, err := NameToConfig("task-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(scope Scope, attach bool) uint64 {
+		cfg := Config{
+			Target:  "test/worker",
+			Regions: []string{"region"},
+			Events:  Events{Base: []perf.Configurator{taskClock}},
+			Options: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+			Scope:   scope,
+		}
+		if attach {
+			cmd := exec.Command("test/worker")
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer cmd.Wait()
+			time.Sleep(100 * time.Millisecond)
+			cfg.Pid = cmd.Process.Pid
+		}
+		total, err := Run(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(total) != 1 {
+			t.Fatalf("expected 1 invocation, got %d", len(total))
+		}
+		return total[0].Results[0].Value
+	}
+
+	// the worker spins for about 100ms while the main thread waits for it
+	if v := run(ScopeThread, false); v > uint64(20*time.Millisecond) {
+		t.Errorf("thread scope: got %v of task-clock, expected only the waiting thread", time.Duration(v))
+	}
+	for _, attach := range []bool{false, true} {
+		if v := run(ScopeProcess, attach); v < uint64(20*time.Millisecond) {
+			t.Errorf("process scope (attach %v): got %v of task-clock, expected the worker to be counted", attach, time.Duration(v))
+		}
+	}
+}
+
+// Tests that a library is traced every time it is loaded, and that a region
+// that is open when its library is unloaded ends there.
+func TestReloadedLibrary(t *testing.T) {
+	if err := buildC("test/libwork.c", "test/libwork.so", "-shared", "-fPIC"); err != nil {
+		t.Skip("cannot build test/libwork.c:", err)
+	}
+	if err := buildC("test/dlopen.c", "test/dlopen", "-ldl"); err != nil {
+		t.Skip("cannot build test/dlopen.c:", err)
+	}
+	taskClock, err := NameToConfig("task-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the range from begin to end is open when the library is unloaded
+	open := "libwork.so:libwork.c:13-libwork.c:17"
+	total, err := Run(Config{
+		Target:  "test/dlopen",
+		Regions: []string{"libwork.so:work", open},
+		Events:  Events{Base: []perf.Configurator{taskClock}},
+		Options: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := make(map[string]int)
+	for _, m := range total {
+		calls[m.Name]++
+	}
+	// every load of the library is traced, even at the address of the last
+	if calls["libwork.so:work"] != 4 {
+		t.Errorf("expected 4 invocations of work, got %d", calls["libwork.so:work"])
+	}
+	// a region that is open when its library is unloaded ends there
+	if calls[open] != 1 {
+		t.Errorf("expected 1 invocation of the open range, got %d", calls[open])
+	}
+}
+
+// Tests that only the outermost invocation of a recursive region is reported
+// by default, and that every invocation is reported with its depth otherwise.
+func TestRecursion(t *testing.T) {
+	if err := buildC("test/recurse.c", "test/recurse"); err != nil {
+		t.Skip("cannot build test/recurse.c:", err)
+	}
+	taskClock, err := NameToConfig("task-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(recursion Recursion) TotalMetrics {
+		total, err := Run(Config{
+			Target:    "test/recurse",
+			Regions:   []string{"depth"},
+			Events:    Events{Base: []perf.Configurator{taskClock}},
+			Options:   perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+			Recursion: recursion,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+
+	// depth(4) is called twice and recurses 4 times each time
+	if total := run(RecursionOuter); len(total) != 2 {
+		t.Errorf("outer recursion: expected 2 invocations, got %d", len(total))
+	}
+	total := run(RecursionAll)
+	if len(total) != 10 {
+		t.Fatalf("all recursion: expected 10 invocations, got %d", len(total))
+	}
+	depths := make(map[int]int)
+	for _, m := range total {
+		depths[m.Depth]++
+	}
+	for d := 0; d <= 4; d++ {
+		if depths[d] != 2 {
+			t.Errorf("all recursion: expected 2 invocations at depth %d, got %d", d, depths[d])
+		}
+	}
+}
+
+// Tests that every invocation is counted when several threads are in a region
+// at the same time.
+func TestThreads(t *testing.T) {
+	if err := buildC("test/threads.c", "test/threads"); err != nil {
+		t.Skip("cannot build test/threads.c:", err)
+	}
+	taskClock, err := NameToConfig("task-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, err := Run(Config{
+		Target:  "test/threads",
+		Regions: []string{"region"},
+		Events:  Events{Base: []perf.Configurator{taskClock}},
+		Options: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 threads each call the region 25 times
+	calls := make(map[int]int)
+	for _, m := range total {
+		calls[m.Tid]++
+	}
+	if len(calls) != 4 {
+		t.Errorf("expected invocations in 4 threads, got %d", len(calls))
+	}
+	for tid, n := range calls {
+		if n != 25 {
+			t.Errorf("thread %d: expected 25 invocations, got %d", tid, n)
+		}
+	}
+}
+
+// Tests that a session whose context is done stops with the metrics collected
+// so far, and that the target keeps running normally after it is detached.
+func TestContextTimeout(t *testing.T) {
+	if err := buildC("test/loop.c", "test/loop"); err != nil {
+		t.Skip("cannot build test/loop.c:", err)
+	}
+	taskClock, err := NameToConfig("task-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("test/loop")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	s := NewSession(Config{
+		Pid:     cmd.Process.Pid,
+		Regions: []string{"region"},
+		Events:  Events{Base: []perf.Configurator{taskClock}},
+		Options: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+	})
+	if err := s.StartContext(ctx); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal(err)
+	}
+	total, err := s.Wait()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	// the region is entered 40 times in about a second
+	if len(total) == 0 || len(total) >= 40 {
+		t.Errorf("expected some of the 40 invocations, got %d", len(total))
+	}
+	// a breakpoint left in the region would kill the target with SIGTRAP
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("target did not exit normally after detaching: %v", err)
+	}
+}
+
+// Tests that the regions of a program that is executed through a wrapper are
+// traced when following exec, and that the binary filter selects programs.
+func TestFollowExec(t *testing.T) {
+	if err := buildC("test/recurse.c", "test/recurse"); err != nil {
+		t.Skip("cannot build test/recurse.c:", err)
+	}
+	taskClock, err := NameToConfig("task-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(binary string) int {
+		total, err := Run(Config{
+			Target:     "/bin/sh",
+			Args:       []string{"-c", "test/recurse && test/recurse"},
+			Regions:    []string{"depth"},
+			Events:     Events{Base: []perf.Configurator{taskClock}},
+			Options:    perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+			FollowExec: true,
+			Binary:     binary,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(total)
+	}
+
+	// the shell executes the program twice, which calls depth twice
+	if n := run(""); n != 4 {
+		t.Errorf("expected 4 invocations, got %d", n)
+	}
+	if n := run("recurse"); n != 4 {
+		t.Errorf("binary recurse: expected 4 invocations, got %d", n)
+	}
+	if n := run("sh"); n != 0 {
+		t.Errorf("binary sh: expected no invocations, got %d", n)
+	}
+}
+
+// Tests that a running process is traced when attaching to it, and that it
+// keeps running after the session is closed.
+func TestAttach(t *testing.T) {
+	if err := buildC("test/loop.c", "test/loop"); err != nil {
+		t.Skip("cannot build test/loop.c:", err)
+	}
+	taskClock, err := NameToConfig("task-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("test/loop")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	pid := cmd.Process.Pid
+	s := NewSession(Config{
+		Pid:     pid,
+		Regions: []string{"region"},
+		Events:  Events{Base: []perf.Configurator{taskClock}},
+		Options: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+	})
+	if err := s.Start(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal(err)
+	}
+	// closing the session is what interrupting the command line tool does
+	time.Sleep(300 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	total, _ := s.Wait()
+	if len(total) == 0 {
+		t.Error("expected invocations while attached")
+	}
+	for _, m := range total {
+		if m.Pid != pid || m.Tid != pid {
+			t.Errorf("expected an invocation in %d, got %d/%d", pid, m.Pid, m.Tid)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("target did not exit normally after detaching: %v", err)
+	}
+}
+
+// Tests the lifecycle of a session, and that sessions may be used from any
+// goroutine, including several at once.
+func TestSession(t *testing.T) {
+	if err := buildC("test/recurse.c", "test/recurse"); err != nil {
+		t.Skip("cannot build test/recurse.c:", err)
+	}
+	taskClock, err := NameToConfig("task-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Target:  "test/recurse",
+		Regions: []string{"depth"},
+		Events:  Events{Base: []perf.Configurator{taskClock}},
+		Options: perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+	}
+
+	s := NewSession(cfg)
+	if _, err := s.Wait(); err != ErrSessionNotStarted {
+		t.Errorf("wait before start: expected %v, got %v", ErrSessionNotStarted, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("close before start: %v", err)
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			s := NewSession(cfg)
+			if err := s.Start(); err != nil {
+				errs <- err
+				return
+			}
+			if err := s.Start(); err != ErrSessionStarted {
+				errs <- fmt.Errorf("second start: expected %v, got %v", ErrSessionStarted, err)
+				return
+			}
+			total, err := s.Wait()
+			if err == nil && len(total) != 2 {
+				err = fmt.Errorf("expected 2 invocations, got %d", len(total))
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// Tests that a reporter is called for the start and end of the session and
+// for every invocation, with the thread and index of the invocation.
+func TestReporter(t *testing.T) {
+	if err := buildC("test/threads.c", "test/threads"); err != nil {
+		t.Skip("cannot build test/threads.c:", err)
+	}
+	taskClock, err := NameToConfig("task-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &collector{}
+	total, err := Run(Config{
+		Target:   "test/threads",
+		Regions:  []string{"region"},
+		Events:   Events{Base: []perf.Configurator{taskClock}},
+		Options:  perf.Options{ExcludeKernel: true, ExcludeHypervisor: true},
+		Reporter: c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.info.Regions) != 1 || c.info.Regions[0] != "region" {
+		t.Errorf("unexpected regions at session start: %v", c.info.Regions)
+	}
+	if len(c.info.Events) != 1 || c.info.Events[0] != "task-clock" {
+		t.Errorf("unexpected events at session start: %v", c.info.Events)
+	}
+	if len(c.total) != len(total) {
+		t.Errorf("expected %d invocations at session end, got %d", len(total), len(c.total))
+	}
+	// 4 threads each call the region 25 times
+	if len(c.enters) != 100 || len(c.exits) != 100 {
+		t.Fatalf("expected 100 enters and exits, got %d and %d", len(c.enters), len(c.exits))
+	}
+	entered := make(map[int]RegionEvent)
+	for i, ev := range c.enters {
+		if ev.Invocation != i {
+			t.Errorf("expected invocation %d to be entered, got %d", i, ev.Invocation)
+		}
+		entered[ev.Invocation] = ev
+	}
+	for _, ev := range c.exits {
+		enter := entered[ev.Invocation]
+		if ev.Tid != enter.Tid || ev.Pid != enter.Pid {
+			t.Errorf("invocation %d entered in %d/%d and exited in %d/%d", ev.Invocation, enter.Pid, enter.Tid, ev.Pid, ev.Tid)
+		}
+		if !ev.Start.Equal(enter.Start) || ev.End.Before(ev.Start) {
+			t.Errorf("invocation %d: unexpected times %v to %v", ev.Invocation, ev.Start, ev.End)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package perforator
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zyedidia/perforator/bininfo"
+)
+
+// A PprofReporter is a Reporter that writes the results of the session as a
+// gzip-compressed pprof profile (profile.proto), which can be read with 'go
+// tool pprof'. Each event is a sample type and each region is a location,
+// resolved to its function, file and line in the traced binary when
+// possible. Nested regions are stacks, so the flat value of a region is its
+// exclusive count and the cumulative value is its inclusive count. The
+// profile is written when the session ends.
+type PprofReporter struct {
+	BaseReporter
+
+	w     io.Writer
+	delim string
+	info  SessionInfo
+	start time.Time
+	err   error
+}
+
+// NewPprofReporter returns a reporter that writes a profile to w. Regions
+// containing 'rangeInnerDelimiter' are address ranges, as in the
+// configuration of the session.
+func NewPprofReporter(w io.Writer, rangeInnerDelimiter string) *PprofReporter {
+	return &PprofReporter{
+		w:     w,
+		delim: rangeInnerDelimiter,
+	}
+}
+
+// Err returns the error that occurred while writing the profile, if any.
+func (r *PprofReporter) Err() error {
+	return r.err
+}
+
+// SessionStart remembers the binary that the regions are resolved in.
+func (r *PprofReporter) SessionStart(info SessionInfo) {
+	r.info = info
+	r.start = time.Now()
+}
+
+// SessionEnd writes the profile.
+func (r *PprofReporter) SessionEnd(total TotalMetrics, err error) {
+	var bin *bininfo.BinFile
+	if f, err := os.Open(r.info.Binary); err == nil {
+		bin, _ = bininfo.Read(f, r.info.Binary)
+		f.Close()
+	}
+	// the binary may have been rebuilt since a record was made
+	if bin != nil && r.info.BuildID != "" && bin.BuildID() != r.info.BuildID {
+		bin = nil
+	}
+
+	gz := gzip.NewWriter(r.w)
+	_, r.err = gz.Write(total.pprof(r.info, bin, r.delim, r.start, time.Since(r.start)))
+	if err := gz.Close(); r.err == nil {
+		r.err = err
+	}
+}
+
+// pprof encodes the nesting tree of regions as a pprof profile. The regions
+// are resolved in 'bin' if it is not nil.
+func (t TotalMetrics) pprof(info SessionInfo, bin *bininfo.BinFile, delim string, start time.Time, duration time.Duration) []byte {
+	p := &pprofBuilder{
+		strings: map[string]int64{"": 0},
+		table:   []string{""},
+		locs:    make(map[string]uint64),
+		specs:   make(map[string]string),
+	}
+	for i, name := range info.Names {
+		if i < len(info.Regions) {
+			p.specs[name] = info.Regions[i]
+		}
+	}
+
+	// the labels of all events in the order they first appear
+	var labels []string
+	index := make(map[string]int)
+	var collect func(n *TreeNode)
+	collect = func(n *TreeNode) {
+		for _, res := range n.Exclusive.Results {
+			if _, ok := index[res.Label]; !ok {
+				index[res.Label] = len(labels)
+				labels = append(labels, res.Label)
+			}
+		}
+		for _, c := range n.Children {
+			collect(c)
+		}
+	}
+	tree := t.Tree(GroupNone)
+	for _, n := range tree {
+		collect(n)
+	}
+
+	var prof protobuf
+	for _, l := range labels {
+		prof.message(1, p.valueType(l, "count"))
+	}
+	prof.message(1, p.valueType("time-elapsed", "nanoseconds"))
+
+	var sample func(n *TreeNode, stack []uint64)
+	sample = func(n *TreeNode, stack []uint64) {
+		stack = append([]uint64{p.location(n.Name, bin, delim)}, stack...)
+		values := make([]uint64, len(labels)+1)
+		for _, res := range n.Exclusive.Results {
+			values[index[res.Label]] = res.Value
+		}
+		values[len(labels)] = uint64(n.Exclusive.Elapsed)
+
+		var s protobuf
+		s.packed(1, stack)
+		s.packed(2, values)
+		prof.message(2, s)
+		for _, c := range n.Children {
+			sample(c, stack)
+		}
+	}
+	for _, n := range tree {
+		sample(n, nil)
+	}
+
+	if bin != nil {
+		var m protobuf
+		m.uint(1, 1)
+		m.uint(3, p.limit)
+		m.uint(5, uint64(p.str(info.Binary)))
+		m.uint(6, uint64(p.str(info.BuildID)))
+		// every location is already symbolized
+		m.uint(7, 1)
+		m.uint(8, 1)
+		m.uint(9, 1)
+		prof.message(3, m)
+	}
+	for _, loc := range p.locations {
+		prof.message(4, loc)
+	}
+	for _, fn := range p.functions {
+		prof.message(5, fn)
+	}
+	if len(labels) > 0 {
+		prof.uint(14, uint64(p.str(labels[0])))
+	}
+	prof.uint(9, uint64(start.UnixNano()))
+	prof.uint(10, uint64(duration))
+	for _, s := range p.table {
+		prof.string(6, s)
+	}
+	return prof.bytes
+}
+
+// A pprofBuilder builds the string table, locations and functions of a
+// profile.
+type pprofBuilder struct {
+	strings map[string]int64
+	table   []string
+	locs    map[string]uint64
+	// the region that each name was given to
+	specs     map[string]string
+	locations []protobuf
+	functions []protobuf
+	// limit is above the address of every location
+	limit uint64
+}
+
+// str returns the index of a string in the string table, adding it if
+// needed.
+func (p *pprofBuilder) str(s string) int64 {
+	if i, ok := p.strings[s]; ok {
+		return i
+	}
+	i := int64(len(p.table))
+	p.strings[s] = i
+	p.table = append(p.table, s)
+	return i
+}
+
+func (p *pprofBuilder) valueType(typ, unit string) protobuf {
+	var vt protobuf
+	vt.uint(1, uint64(p.str(typ)))
+	vt.uint(2, uint64(p.str(unit)))
+	return vt
+}
+
+// location returns the ID of the location of a region, adding the location
+// and its function if needed.
+func (p *pprofBuilder) location(region string, bin *bininfo.BinFile, delim string) uint64 {
+	if id, ok := p.locs[region]; ok {
+		return id
+	}
+	id := uint64(len(p.locations) + 1)
+	p.locs[region] = id
+
+	spec, ok := p.specs[region]
+	if !ok {
+		spec = region
+	}
+	addr, ok := resolveAddr(spec, bin, delim)
+	var sym, file string
+	var line int
+	if ok {
+		sym, _ = bin.PCToFunc(addr)
+		file, line, _ = bin.PCToLine(addr)
+		if addr >= p.limit {
+			p.limit = addr + 1
+		}
+	}
+
+	var fn protobuf
+	fn.uint(1, id)
+	fn.uint(2, uint64(p.str(region)))
+	fn.uint(3, uint64(p.str(sym)))
+	fn.uint(4, uint64(p.str(file)))
+	fn.uint(5, uint64(line))
+	p.functions = append(p.functions, fn)
+
+	var ln, loc protobuf
+	ln.uint(1, id)
+	ln.uint(2, uint64(line))
+	loc.uint(1, id)
+	if ok {
+		loc.uint(2, 1)
+		loc.uint(3, addr)
+	}
+	loc.message(4, ln)
+	p.locations = append(p.locations, loc)
+	return id
+}
+
+// resolveAddr returns the address of the start of a region in the binary,
+// which is the entry of a function or the start of a range. Regions in
+// shared libraries are not resolved.
+func resolveAddr(region string, bin *bininfo.BinFile, delim string) (uint64, bool) {
+	if bin == nil {
+		return 0, false
+	}
+	lib, name := splitLibrary(region)
+	if lib != "" {
+		return 0, false
+	}
+	if strings.Contains(name, delim) {
+		reg, err := ParseRegion(name, bin, delim)
+		if err != nil {
+			return 0, false
+		}
+		return reg.StartAddr, true
+	}
+	if addr, err := bin.FuncToPC(name, false); err == nil {
+		return addr, true
+	}
+	if inlinings, err := bin.InlinedFuncToPCs(name, false); err == nil && len(inlinings) > 0 {
+		return inlinings[0].Low, true
+	}
+	return 0, false
+}
+
+// protobuf is an encoded protocol buffer message. Only the wire types used
+// by profile.proto are supported.
+type protobuf struct {
+	bytes []byte
+}
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.bytes = append(b.bytes, byte(x)|0x80)
+		x >>= 7
+	}
+	b.bytes = append(b.bytes, byte(x))
+}
+
+// key writes the key of a field with the given wire type.
+func (b *protobuf) key(field int, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// uint writes an integer field, unless it is zero (the default).
+func (b *protobuf) uint(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(x)
+}
+
+// packed writes a repeated integer field in packed form.
+func (b *protobuf) packed(field int, xs []uint64) {
+	var p protobuf
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.message(field, p)
+}
+
+// string writes a string field, even if it is empty, since the empty string
+// is the first element of a string table.
+func (b *protobuf) string(field int, s string) {
+	b.key(field, 2)
+	b.varint(uint64(len(s)))
+	b.bytes = append(b.bytes, s...)
+}
+
+// message writes an embedded message.
+func (b *protobuf) message(field int, m protobuf) {
+	b.key(field, 2)
+	b.varint(uint64(len(m.bytes)))
+	b.bytes = append(b.bytes, m.bytes...)
+}
@@ -0,0 +1,119 @@
+package perforator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+// decodeProto splits an encoded protocol buffer message into its fields,
+// with varints as integers and length-delimited fields as bytes.
+func decodeProto(t *testing.T, b []byte) map[int][]interface{} {
+	fields := make(map[int][]interface{})
+	varint := func() uint64 {
+		var x uint64
+		for shift := uint(0); ; shift += 7 {
+			if len(b) == 0 {
+				t.Fatal("truncated varint")
+			}
+			c := b[0]
+			b = b[1:]
+			x |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return x
+			}
+		}
+	}
+	for len(b) > 0 {
+		key := varint()
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			fields[field] = append(fields[field], varint())
+		case 2:
+			n := varint()
+			fields[field] = append(fields[field], b[:n])
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestPprof(t *testing.T) {
+	total := TotalMetrics{
+		named("leaf", 10, count("instructions", 10)).within("main"),
+		named("main", 100, count("instructions", 100)),
+	}
+
+	var buf bytes.Buffer
+	r := NewPprofReporter(&buf, "-")
+	r.SessionStart(SessionInfo{Binary: "/nonexistent"})
+	r.SessionEnd(total, nil)
+	if r.Err() != nil {
+		t.Fatal(r.Err())
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prof := decodeProto(t, data)
+	var strs []string
+	for _, s := range prof[6] {
+		strs = append(strs, string(s.([]byte)))
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("the string table must start with the empty string: %q", strs)
+	}
+	str := func(v interface{}) string {
+		return strs[v.(uint64)]
+	}
+
+	var types []string
+	for _, st := range prof[1] {
+		vt := decodeProto(t, st.([]byte))
+		types = append(types, str(vt[1][0])+"/"+str(vt[2][0]))
+	}
+	if len(types) != 2 || types[0] != "instructions/count" || types[1] != "time-elapsed/nanoseconds" {
+		t.Errorf("unexpected sample types: %v", types)
+	}
+
+	names := make(map[uint64]string)
+	for _, fn := range prof[5] {
+		f := decodeProto(t, fn.([]byte))
+		names[f[1][0].(uint64)] = str(f[2][0])
+	}
+	if len(prof[4]) != 2 || len(prof[3]) != 0 {
+		t.Errorf("expected 2 locations and no mapping, got %d and %d", len(prof[4]), len(prof[3]))
+	}
+
+	// the stack of a sample is leaf first, and its values are exclusive
+	samples := make(map[string][]byte)
+	for _, s := range prof[2] {
+		fields := decodeProto(t, s.([]byte))
+		var stack string
+		for _, loc := range fields[1][0].([]byte) {
+			stack += names[uint64(loc)] + ";"
+		}
+		samples[stack] = fields[2][0].([]byte)
+	}
+	want := map[string][]byte{
+		"main;":      {90, 90},
+		"leaf;main;": {10, 10},
+	}
+	if len(samples) != len(want) {
+		t.Errorf("unexpected samples: %v", samples)
+	}
+	for stack, v := range want {
+		if !bytes.Equal(samples[stack], v) {
+			t.Errorf("%s: got values %v, want %v", stack, samples[stack], v)
+		}
+	}
+}
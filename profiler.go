@@ -14,6 +14,7 @@ type Profiler interface {
 	Disable() error
 	Reset() error
 	Metrics() Metrics
+	Close() error
 }
 
 // MultiError stores multiple errors.
@@ -48,6 +49,7 @@ type SingleProfiler struct {
 	// so whenever there is a reset we manually track the time enabled so far
 	// so that we can subtract it from the total
 	enabled time.Duration
+	running time.Duration
 }
 
 // NewSingleProfiler opens a new profiler for the given event and process.
@@ -64,27 +66,41 @@ func (p *SingleProfiler) Reset() error {
 	if err != nil {
 		return err
 	}
-	p.enabled = c.Enabled
+	p.enabled, p.running = c.Enabled, c.Running
 	return p.Event.Reset()
 }
 
 // Metrics returns the collected metrics.
 func (p *SingleProfiler) Metrics() Metrics {
 	c, _ := p.ReadCount()
-	if c.Enabled != c.Running {
-		logger.Printf("%s: multiplexing occurred (enabled: %s, running %s)\n", c.Label, c.Enabled, c.Running)
+	enabled, running := c.Enabled-p.enabled, c.Running-p.running
+	if enabled != running {
+		logger.Printf("%s: multiplexing occurred (enabled: %s, running %s)\n", c.Label, enabled, running)
 	}
 	return Metrics{
 		Results: []Result{
-			{
-				Value: uint64(float64(c.Value) * float64(c.Enabled) / float64(c.Running)),
-				Label: c.Label,
-			},
+			scaled(c.Label, c.Value, enabled, running),
 		},
-		Elapsed: c.Enabled - p.enabled,
+		Elapsed: enabled,
 	}
 }
 
+// scaled returns the result of an event that counted 'raw' while it was
+// running, scaled to the time that it was enabled. An event that never ran
+// has a value of zero and is reported as not counted.
+func scaled(label string, raw uint64, enabled, running time.Duration) Result {
+	r := Result{
+		Label:   label,
+		Raw:     raw,
+		Enabled: enabled,
+		Running: running,
+	}
+	if running > 0 {
+		r.Value = uint64(float64(raw) * r.Scale())
+	}
+	return r
+}
+
 // A MultiProfiler runs multiple profilers, each of which may profile for
 // groups of events.
 type MultiProfiler struct {
@@ -144,6 +160,18 @@ func (p *MultiProfiler) Reset() error {
 	return MultiErr(errs)
 }
 
+// Close releases the resources of all profilers.
+func (p *MultiProfiler) Close() error {
+	var errs []error
+	for _, prof := range p.profilers {
+		err := prof.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return MultiErr(errs)
+}
+
 // Metrics returns the collected metrics.
 func (p *MultiProfiler) Metrics() Metrics {
 	results := make([]Result, 0, len(p.profilers))
@@ -164,6 +192,7 @@ func (p *MultiProfiler) Metrics() Metrics {
 type GroupProfiler struct {
 	*perf.Event
 	enabled time.Duration
+	running time.Duration
 }
 
 // NewGroupProfiler creates a profiler for measuring the set of given perf
@@ -188,32 +217,104 @@ func (p *GroupProfiler) Reset() error {
 	if err != nil {
 		return err
 	}
-	p.enabled = gc.Enabled
+	p.enabled, p.running = gc.Enabled, gc.Running
 	return p.Event.Reset()
 }
 
 // Metrics returns the collected group event metrics.
 func (p *GroupProfiler) Metrics() Metrics {
 	gc, _ := p.ReadGroupCount()
-
-	if gc.Running == 0 {
-		return Metrics{}
-	}
-
-	scale := float64(gc.Enabled) / float64(gc.Running)
-	if gc.Enabled != gc.Running {
-		logger.Printf("%s: multiplexing occurred (enabled: %s, running %s)\n", "group", gc.Enabled, gc.Running)
+	enabled, running := gc.Enabled-p.enabled, gc.Running-p.running
+	if enabled != running {
+		logger.Printf("%s: multiplexing occurred (enabled: %s, running %s)\n", "group", enabled, running)
 	}
 
 	var results []Result
 	for _, v := range gc.Values {
-		results = append(results, Result{
-			Value: uint64(float64(v.Value) * scale),
-			Label: v.Label,
-		})
+		results = append(results, scaled(v.Label, v.Value, enabled, running))
 	}
 	return Metrics{
 		Results: results,
-		Elapsed: gc.Enabled - p.enabled,
+		Elapsed: enabled,
+	}
+}
+
+// A SumProfiler adds up the metrics of profilers that measure the same
+// events on different threads, so that a whole process is measured as one.
+// Profilers may be added while it is running.
+type SumProfiler struct {
+	profilers []Profiler
+	enabled   bool
+}
+
+// Add adds a profiler, and enables it if the SumProfiler is enabled.
+func (p *SumProfiler) Add(prof Profiler) error {
+	p.profilers = append(p.profilers, prof)
+	if p.enabled {
+		return prof.Enable()
+	}
+	return nil
+}
+
+// Enable recording of all events.
+func (p *SumProfiler) Enable() error {
+	p.enabled = true
+	var errs []error
+	for _, prof := range p.profilers {
+		if err := prof.Enable(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return MultiErr(errs)
+}
+
+// Disable recording of all events.
+func (p *SumProfiler) Disable() error {
+	p.enabled = false
+	var errs []error
+	for _, prof := range p.profilers {
+		if err := prof.Disable(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return MultiErr(errs)
+}
+
+// Reset the collected metrics.
+func (p *SumProfiler) Reset() error {
+	var errs []error
+	for _, prof := range p.profilers {
+		if err := prof.Reset(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return MultiErr(errs)
+}
+
+// Close releases the resources of all profilers.
+func (p *SumProfiler) Close() error {
+	var errs []error
+	for _, prof := range p.profilers {
+		if err := prof.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return MultiErr(errs)
+}
+
+// Metrics returns the sum of the metrics of all profilers. The counts and
+// the enabled and running times of each event are summed, and the elapsed
+// time is the longest of any profiler, since the threads ran concurrently.
+func (p *SumProfiler) Metrics() Metrics {
+	var sum Metrics
+	for _, prof := range p.profilers {
+		m := prof.Metrics()
+		elapsed := sum.Elapsed
+		sum = sum.add(m)
+		sum.Elapsed = elapsed
+		if m.Elapsed > sum.Elapsed {
+			sum.Elapsed = m.Elapsed
+		}
 	}
+	return sum
 }
@@ -0,0 +1,52 @@
+package perforator
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeProfiler is a Profiler that returns fixed metrics and records whether
+// it is enabled.
+type fakeProfiler struct {
+	m       Metrics
+	enabled bool
+}
+
+func (p *fakeProfiler) Enable() error    { p.enabled = true; return nil }
+func (p *fakeProfiler) Disable() error   { p.enabled = false; return nil }
+func (p *fakeProfiler) Reset() error     { return nil }
+func (p *fakeProfiler) Metrics() Metrics { return p.m }
+func (p *fakeProfiler) Close() error     { return nil }
+
+func TestSumProfiler(t *testing.T) {
+	thread := func(v uint64, elapsed time.Duration) *fakeProfiler {
+		return &fakeProfiler{m: Metrics{
+			Results: []Result{{Label: "instructions", Value: v, Raw: v, Enabled: elapsed, Running: elapsed}},
+			Elapsed: elapsed,
+		}}
+	}
+	a, b := thread(10, 3*time.Second), thread(5, time.Second)
+
+	var sum SumProfiler
+	sum.Add(a)
+	sum.Enable()
+	// a thread created while the process is counted is counted as well
+	sum.Add(b)
+	if !a.enabled || !b.enabled {
+		t.Error("every profiler should be enabled")
+	}
+
+	m := sum.Metrics()
+	if r := m.Results[0]; r.Value != 15 || r.Enabled != 4*time.Second || r.Scale() != 1 {
+		t.Errorf("unexpected sum: %+v", r)
+	}
+	if m.Elapsed != 3*time.Second {
+		t.Errorf("got elapsed %v, want the longest of the threads", m.Elapsed)
+	}
+
+	sum.Disable()
+	sum.Add(thread(1, time.Second))
+	if a.enabled || sum.profilers[2].(*fakeProfiler).enabled {
+		t.Error("profilers should be disabled")
+	}
+}
@@ -0,0 +1,300 @@
+package perforator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// RecordVersion is the version of the record format written by a
+// RecordReporter. It is increased whenever the format changes in a way that
+// older versions cannot read.
+const RecordVersion = 1
+
+// A Record is everything collected during a session, in a form that can be
+// saved and reported on later. A record is written as a single JSON object,
+// or in JSON Lines format as a header object without invocations followed by
+// one object for each invocation.
+type Record struct {
+	Version int `json:"version"`
+	// Binary is the path of the traced executable and BuildID is its GNU
+	// build ID, if it has one.
+	Binary  string `json:"binary"`
+	BuildID string `json:"build_id,omitempty"`
+	// Regions is the list of region specs that were profiled.
+	Regions []string `json:"regions"`
+	// Names are the names that the regions were reported with, if they
+	// were given names.
+	Names []string `json:"names,omitempty"`
+	// RangeInnerDelimiter separates the start and end of range regions. It
+	// is "-" if it is empty.
+	RangeInnerDelimiter string `json:"range_inner_delimiter,omitempty"`
+	// Events is the list of labels of the events that were measured.
+	Events []string `json:"events"`
+	// Metrics is the list of derived metrics that were computed.
+	Metrics []*Formula `json:"metrics,omitempty"`
+	// Repeat is the number of times the target was run.
+	Repeat      int          `json:"repeat"`
+	Invocations []Invocation `json:"invocations,omitempty"`
+}
+
+// An Invocation is a single invocation of a region and the results of every
+// event. The derived metrics are not stored, since they can be computed
+// again from the results.
+type Invocation struct {
+	Region     string        `json:"region"`
+	Run        int           `json:"run,omitempty"`
+	Pid        int           `json:"pid"`
+	Tid        int           `json:"tid"`
+	Comm       string        `json:"comm,omitempty"`
+	Invocation int           `json:"invocation"`
+	Depth      int           `json:"depth,omitempty"`
+	Stack      []string      `json:"stack,omitempty"`
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	Elapsed    time.Duration `json:"elapsed"`
+	Results    []Result      `json:"results"`
+}
+
+// ReadRecord reads a record written in either format by a RecordReporter.
+func ReadRecord(r io.Reader) (*Record, error) {
+	dec := json.NewDecoder(r)
+	rec := &Record{}
+	if err := dec.Decode(rec); err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	if rec.Version != RecordVersion {
+		return nil, fmt.Errorf("record: unsupported version %d (expected %d)", rec.Version, RecordVersion)
+	}
+	for {
+		var inv Invocation
+		err := dec.Decode(&inv)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("record: invocation %d: %w", len(rec.Invocations), err)
+		}
+		rec.Invocations = append(rec.Invocations, inv)
+	}
+	return rec, nil
+}
+
+// metrics returns the metrics of an invocation with the derived metrics
+// given by 'formulas'.
+func (inv Invocation) metrics(formulas []*Formula) NamedMetrics {
+	return NamedMetrics{
+		Metrics: Metrics{
+			Results: inv.Results,
+			Elapsed: inv.Elapsed,
+		}.derive(formulas),
+		Name:  inv.Region,
+		Run:   inv.Run,
+		Pid:   inv.Pid,
+		Tid:   inv.Tid,
+		Comm:  inv.Comm,
+		Depth: inv.Depth,
+		Stack: inv.Stack,
+	}
+}
+
+// Total returns the metrics of every invocation in the record.
+func (rec *Record) Total() TotalMetrics {
+	total := make(TotalMetrics, len(rec.Invocations))
+	for i, inv := range rec.Invocations {
+		total[i] = inv.metrics(rec.Metrics)
+	}
+	return total
+}
+
+// Replay sends the recorded session to a reporter as if it was happening
+// again, so that a record can be rendered like a live session.
+func (rec *Record) Replay(r Reporter) {
+	r.SessionStart(SessionInfo{
+		Binary:              rec.Binary,
+		BuildID:             rec.BuildID,
+		Regions:             rec.Regions,
+		Names:               rec.Names,
+		RangeInnerDelimiter: rec.RangeInnerDelimiter,
+		Events:              rec.Events,
+		Formulas:            rec.Metrics,
+		Repeat:              rec.Repeat,
+	})
+	total := make(TotalMetrics, 0, len(rec.Invocations))
+	for _, inv := range rec.Invocations {
+		ev := RegionEvent{
+			Region:     inv.Region,
+			Run:        inv.Run,
+			Pid:        inv.Pid,
+			Tid:        inv.Tid,
+			Comm:       inv.Comm,
+			Invocation: inv.Invocation,
+			Depth:      inv.Depth,
+			Stack:      inv.Stack,
+			Start:      inv.Start,
+		}
+		r.RegionEnter(ev)
+		ev.End = inv.End
+		nm := inv.metrics(rec.Metrics)
+		total = append(total, nm)
+		r.RegionExit(ev, nm.Metrics)
+	}
+	r.SessionEnd(total, nil)
+}
+
+// A RecordReporter is a Reporter that writes a Record of the session. In
+// JSON Lines format every invocation is written as soon as it exits, so the
+// record is usable even if perforator is killed, and otherwise the record is
+// written when the session ends.
+type RecordReporter struct {
+	BaseReporter
+
+	w     io.Writer
+	jsonl bool
+	rec   Record
+	err   error
+}
+
+// NewRecordReporter returns a reporter that writes a record to w, in JSON
+// Lines format if 'jsonl' is true.
+func NewRecordReporter(w io.Writer, jsonl bool) *RecordReporter {
+	return &RecordReporter{
+		w:     w,
+		jsonl: jsonl,
+	}
+}
+
+// Err returns the first error that occurred while writing the record.
+func (r *RecordReporter) Err() error {
+	return r.err
+}
+
+// Record returns the record of the session so far. It has no invocations in
+// JSON Lines format, since those are written as they exit.
+func (r *RecordReporter) Record() *Record {
+	return &r.rec
+}
+
+func (r *RecordReporter) encode(v interface{}) {
+	if r.err != nil {
+		return
+	}
+	enc := json.NewEncoder(r.w)
+	if !r.jsonl {
+		enc.SetIndent("", "  ")
+	}
+	r.err = enc.Encode(v)
+}
+
+// SessionStart begins the record, and writes its header in JSON Lines format.
+func (r *RecordReporter) SessionStart(info SessionInfo) {
+	r.rec = Record{
+		Version:             RecordVersion,
+		Binary:              info.Binary,
+		BuildID:             info.BuildID,
+		Regions:             info.Regions,
+		Names:               info.Names,
+		RangeInnerDelimiter: info.RangeInnerDelimiter,
+		Events:              info.Events,
+		Metrics:             info.Formulas,
+		Repeat:              info.Repeat,
+	}
+	if r.jsonl {
+		r.encode(r.rec)
+	}
+}
+
+// RegionExit adds the invocation to the record.
+func (r *RecordReporter) RegionExit(ev RegionEvent, m Metrics) {
+	inv := Invocation{
+		Region:     ev.Region,
+		Run:        ev.Run,
+		Pid:        ev.Pid,
+		Tid:        ev.Tid,
+		Comm:       ev.Comm,
+		Invocation: ev.Invocation,
+		Depth:      ev.Depth,
+		Stack:      ev.Stack,
+		Start:      ev.Start,
+		End:        ev.End,
+		Elapsed:    m.Elapsed,
+		Results:    m.Results,
+	}
+	if r.jsonl {
+		r.encode(inv)
+	} else {
+		r.rec.Invocations = append(r.rec.Invocations, inv)
+	}
+}
+
+// SessionEnd writes the record unless it is in JSON Lines format.
+func (r *RecordReporter) SessionEnd(total TotalMetrics, err error) {
+	if !r.jsonl {
+		r.encode(r.rec)
+	}
+}
+
+// MergeRecords merges records of the same program that measured different
+// events, such as the passes made by running the program once for each set
+// of events that can be counted without multiplexing. Invocations are matched
+// by region and invocation index, so the program must invoke its regions in
+// the same way in every run. The results of each invocation are ordered as in
+// 'events', and the times are those of the first record. Invocations that are
+// missing from some record are left out, and their number is returned.
+func MergeRecords(recs []*Record, events []string) (*Record, int) {
+	if len(recs) == 0 {
+		return &Record{Version: RecordVersion}, 0
+	}
+	type key struct {
+		region     string
+		invocation int
+	}
+	merged := *recs[0]
+	merged.Events = nil
+	merged.Invocations = nil
+
+	results := make(map[key][]Result)
+	found := make(map[key]int)
+	for _, rec := range recs {
+		merged.Events = append(merged.Events, rec.Events...)
+		for _, inv := range rec.Invocations {
+			k := key{inv.Region, inv.Invocation}
+			results[k] = append(results[k], inv.Results...)
+			found[k]++
+		}
+	}
+
+	order := make(map[string]int)
+	for i, label := range events {
+		order[label] = i
+	}
+	rank := func(label string) int {
+		if i, ok := order[label]; ok {
+			return i
+		}
+		return len(events)
+	}
+	sort.SliceStable(merged.Events, func(i, j int) bool {
+		return rank(merged.Events[i]) < rank(merged.Events[j])
+	})
+
+	for _, inv := range recs[0].Invocations {
+		k := key{inv.Region, inv.Invocation}
+		if found[k] != len(recs) {
+			continue
+		}
+		inv.Results = results[k]
+		sort.SliceStable(inv.Results, func(i, j int) bool {
+			return rank(inv.Results[i].Label) < rank(inv.Results[j].Label)
+		})
+		merged.Invocations = append(merged.Invocations, inv)
+	}
+	dropped := 0
+	for _, n := range found {
+		if n != len(recs) {
+			dropped++
+		}
+	}
+	return &merged, dropped
+}
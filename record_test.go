@@ -0,0 +1,110 @@
+package perforator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collector is a Reporter that keeps the metrics of every invocation.
+type collector struct {
+	BaseReporter
+	info   SessionInfo
+	enters []RegionEvent
+	exits  []RegionEvent
+	total  TotalMetrics
+}
+
+func (c *collector) SessionStart(info SessionInfo) { c.info = info }
+
+func (c *collector) RegionEnter(ev RegionEvent) { c.enters = append(c.enters, ev) }
+
+func (c *collector) RegionExit(ev RegionEvent, m Metrics) { c.exits = append(c.exits, ev) }
+
+func (c *collector) SessionEnd(total TotalMetrics, err error) { c.total = total }
+
+func TestRecord(t *testing.T) {
+	ipc, err := ParseFormula("ipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(100, 0).UTC()
+
+	for _, jsonl := range []bool{false, true} {
+		var buf bytes.Buffer
+		r := NewRecordReporter(&buf, jsonl)
+		r.SessionStart(SessionInfo{
+			Binary:              "/bin/prog",
+			BuildID:             "abcd",
+			Regions:             []string{"main", "0x10:0x20"},
+			Names:               []string{"main", "work"},
+			RangeInnerDelimiter: ":",
+			Events:              []string{"instructions", "cpu-cycles"},
+			Formulas:            []*Formula{ipc},
+			Repeat:              1,
+		})
+		for i, v := range []uint64{100, 300} {
+			r.RegionExit(RegionEvent{
+				Region:     "work",
+				Run:        1,
+				Pid:        10,
+				Tid:        11,
+				Comm:       "worker",
+				Invocation: i,
+				Stack:      []string{"main"},
+				Start:      start,
+				End:        start.Add(time.Duration(v)),
+			}, Metrics{
+				Results: []Result{
+					{Label: "instructions", Value: v, Raw: v / 2, Enabled: 10, Running: 5},
+					{Label: "cpu-cycles", Value: 2 * v, Raw: v, Enabled: 10, Running: 5},
+				},
+				Elapsed: time.Duration(v),
+			})
+		}
+		r.SessionEnd(nil, nil)
+		if r.Err() != nil {
+			t.Fatal(r.Err())
+		}
+		if lines := strings.Count(buf.String(), "\n"); jsonl && lines != 3 {
+			t.Errorf("jsonl: got %d lines, want 3", lines)
+		}
+
+		rec, err := ReadRecord(&buf)
+		if err != nil {
+			t.Fatalf("jsonl=%v: %v", jsonl, err)
+		}
+		if rec.Binary != "/bin/prog" || rec.BuildID != "abcd" || len(rec.Regions) != 2 || len(rec.Events) != 2 {
+			t.Errorf("jsonl=%v: unexpected header: %+v", jsonl, rec)
+		}
+		if len(rec.Invocations) != 2 {
+			t.Fatalf("jsonl=%v: got %d invocations, want 2", jsonl, len(rec.Invocations))
+		}
+		inv := rec.Invocations[1]
+		if inv.Invocation != 1 || inv.Run != 1 || inv.Comm != "worker" || len(inv.Stack) != 1 || !inv.Start.Equal(start) {
+			t.Errorf("jsonl=%v: unexpected invocation: %+v", jsonl, inv)
+		}
+		if got := inv.Results[0]; got.Value != 300 || got.Raw != 150 || got.Enabled != 10 || got.Running != 5 {
+			t.Errorf("jsonl=%v: unexpected result: %+v", jsonl, got)
+		}
+
+		var c collector
+		rec.Replay(&c)
+		if c.info.Binary != "/bin/prog" || c.info.Names[1] != "work" || c.info.RangeInnerDelimiter != ":" || len(c.exits) != 2 || len(c.total) != 2 {
+			t.Fatalf("jsonl=%v: unexpected replay: %+v", jsonl, c)
+		}
+		// derived metrics are computed again from the recorded formulas
+		d := c.total[0].Derived
+		if len(d) != 1 || d[0].Label != "ipc" || d[0].Value != 0.5 {
+			t.Errorf("jsonl=%v: unexpected derived metrics: %+v", jsonl, d)
+		}
+	}
+}
+
+func TestRecordVersion(t *testing.T) {
+	_, err := ReadRecord(strings.NewReader(`{"version": 2}`))
+	if err == nil {
+		t.Error("expected an error for an unsupported version")
+	}
+}
@@ -2,6 +2,7 @@ package perforator
 
 import (
 	"errors"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -46,3 +47,28 @@ func ParseRegion(s string, bin *bininfo.BinFile, rangeInnerDelimiter string) (*u
 		EndAddr:   end,
 	}, nil
 }
+
+// splitLibrary splits a region written as 'lib:region', where 'lib' is the
+// name of a shared library such as libc.so.6, into the library name and the
+// region. The library name is empty for regions in the executable.
+func splitLibrary(s string) (string, string) {
+	i := strings.Index(s, ":")
+	if i == -1 {
+		return "", s
+	}
+	lib := s[:i]
+	if !strings.HasSuffix(lib, ".so") && !strings.Contains(lib, ".so.") {
+		return "", s
+	}
+	return lib, s[i+1:]
+}
+
+// matchLibrary returns true if 'lib' names the shared library at 'path'. The
+// version may be left out of the name, so libc.so matches libc.so.6.
+func matchLibrary(lib, path string) bool {
+	if lib == "" {
+		return false
+	}
+	base := filepath.Base(path)
+	return lib == base || lib == path || strings.HasPrefix(base, lib+".")
+}
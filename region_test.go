@@ -0,0 +1,29 @@
+package perforator
+
+import "testing"
+
+func TestSplitLibrary(t *testing.T) {
+	tests := []struct {
+		spec, lib, region string
+	}{
+		{"sum", "", "sum"},
+		{"bench.c:19-bench.c:24", "", "bench.c:19-bench.c:24"},
+		{"libfoo.so:compress", "libfoo.so", "compress"},
+		{"libc.so.6:memcpy", "libc.so.6", "memcpy"},
+		{"libfoo.so:foo.c:10-foo.c:20", "libfoo.so", "foo.c:10-foo.c:20"},
+		{"parser.sol:12", "", "parser.sol:12"},
+	}
+	for _, tt := range tests {
+		lib, region := splitLibrary(tt.spec)
+		if lib != tt.lib || region != tt.region {
+			t.Errorf("splitLibrary(%q) = %q, %q; want %q, %q", tt.spec, lib, region, tt.lib, tt.region)
+		}
+	}
+
+	if !matchLibrary("libc.so", "/usr/lib/libc.so.6") || !matchLibrary("libc.so.6", "/usr/lib/libc.so.6") {
+		t.Errorf("libc.so should match libc.so.6")
+	}
+	if matchLibrary("libc.so", "/usr/lib/libcrypt.so.1") {
+		t.Errorf("libc.so should not match libcrypt.so.1")
+	}
+}
@@ -0,0 +1,237 @@
+package perforator
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// SessionInfo describes a tracing session.
+type SessionInfo struct {
+	// Binary is the path of the traced executable and BuildID is its GNU
+	// build ID, if it has one.
+	Binary  string
+	BuildID string
+	// Regions is the list of regions being profiled, and Names are the
+	// names that they are reported with.
+	Regions []string
+	Names   []string
+	// RangeInnerDelimiter separates the start and end of range regions.
+	RangeInnerDelimiter string
+	// Events is the list of labels of the events being measured.
+	Events []string
+	// Formulas is the list of derived metrics being computed.
+	Formulas []*Formula
+	// Repeat is the number of times the target is run.
+	Repeat int
+}
+
+// A RegionEvent describes a thread entering or exiting a region.
+type RegionEvent struct {
+	// Region is the name of the region.
+	Region string
+	// Run is the index of the run of the target that the invocation
+	// happened in, counting from zero (see Config.Repeat).
+	Run int
+	// Pid is the process ID, Tid is the thread ID and Comm is the name of
+	// the thread.
+	Pid  int
+	Tid  int
+	Comm string
+	// Invocation is the index of this invocation of the region, counting
+	// from zero across all threads.
+	Invocation int
+	// Depth is the number of invocations of the region that enclose this
+	// one in the same thread, when recursive invocations are reported.
+	Depth int
+	// Stack is the list of regions that the thread was executing when the
+	// region was entered, outermost first.
+	Stack []string
+	// Start is the time when the region was entered. End is the time when
+	// the region was exited, and is zero when the region is entered.
+	Start time.Time
+	End   time.Time
+}
+
+// A Reporter receives the results of a session as they are collected. All
+// methods are called from the tracing goroutine, so a Reporter does not need
+// to be safe for concurrent use, but it should return quickly since the
+// target is stopped while a method is running.
+type Reporter interface {
+	// SessionStart is called once when the session begins.
+	SessionStart(info SessionInfo)
+	// RegionEnter is called each time a thread enters a region.
+	RegionEnter(ev RegionEvent)
+	// RegionExit is called each time a thread exits a region, with the
+	// metrics collected during this invocation.
+	RegionExit(ev RegionEvent, m Metrics)
+	// Diagnostic is called with messages about events during the session
+	// that may affect the results, such as missing regions.
+	Diagnostic(msg string)
+	// SessionEnd is called once when the session ends, with all metrics
+	// collected and the error that ended the session, if any.
+	SessionEnd(total TotalMetrics, err error)
+}
+
+// BaseReporter is a Reporter that does nothing. It may be embedded in other
+// reporters so that they only need to implement the methods they need.
+type BaseReporter struct{}
+
+// SessionStart does nothing.
+func (BaseReporter) SessionStart(info SessionInfo) {}
+
+// RegionEnter does nothing.
+func (BaseReporter) RegionEnter(ev RegionEvent) {}
+
+// RegionExit does nothing.
+func (BaseReporter) RegionExit(ev RegionEvent, m Metrics) {}
+
+// Diagnostic does nothing.
+func (BaseReporter) Diagnostic(msg string) {}
+
+// SessionEnd does nothing.
+func (BaseReporter) SessionEnd(total TotalMetrics, err error) {}
+
+// ReportOptions configure the output of a TableReporter.
+type ReportOptions struct {
+	// Summary writes one table with every invocation when the session ends
+	// instead of one table for each invocation as soon as it exits.
+	Summary bool
+	// Stats writes statistics for each region and event when the session
+	// ends (see TotalMetrics.Stats), instead of the invocations.
+	Stats bool
+	// SortKey is the column to sort the summary table with, and
+	// ReverseSort reverses the order. If NoSort is set the summary is not
+	// sorted.
+	SortKey     string
+	ReverseSort bool
+	NoSort      bool
+	// GroupBy aggregates the invocations in the summary and statistics by
+	// region, thread or process.
+	GroupBy GroupBy
+	// Tree writes the nesting tree of regions with inclusive and exclusive
+	// counts when the session ends (see TotalMetrics.Tree), instead of the
+	// invocations or statistics.
+	Tree bool
+	// Scaling configures how the invocations and summary show the scaling
+	// of events that were multiplexed.
+	Scaling Scaling
+}
+
+// A TableReporter is a Reporter that writes results as tables, either
+// pretty-printed or in CSV format.
+type TableReporter struct {
+	BaseReporter
+	ReportOptions
+
+	w         io.Writer
+	newWriter func(w io.Writer) MetricsWriter
+}
+
+// NewTableReporter returns a reporter that writes pretty-printed ASCII tables
+// to w.
+func NewTableReporter(w io.Writer, opts ReportOptions) *TableReporter {
+	return &TableReporter{
+		ReportOptions: opts,
+		w:             w,
+		newWriter: func(w io.Writer) MetricsWriter {
+			return NewTableWriter(w)
+		},
+	}
+}
+
+// NewCSVReporter returns a reporter that writes tables in CSV format to w.
+func NewCSVReporter(w io.Writer, opts ReportOptions) *TableReporter {
+	return &TableReporter{
+		ReportOptions: opts,
+		w:             w,
+		newWriter: func(w io.Writer) MetricsWriter {
+			return NewCSVWriter(w)
+		},
+	}
+}
+
+// RegionExit writes a table with the metrics of the invocation unless a
+// summary is requested.
+func (r *TableReporter) RegionExit(ev RegionEvent, m Metrics) {
+	if r.Summary || r.Stats || r.Tree {
+		return
+	}
+	nm := NamedMetrics{
+		Metrics: m,
+		Name:    ev.Region,
+		Run:     ev.Run,
+		Pid:     ev.Pid,
+		Tid:     ev.Tid,
+		Comm:    ev.Comm,
+		Depth:   ev.Depth,
+	}
+	nm.WriteScaled(r.newWriter(r.w), r.Scaling)
+}
+
+// Diagnostic writes the message to standard error.
+func (r *TableReporter) Diagnostic(msg string) {
+	fmt.Fprintln(os.Stderr, "perforator:", msg)
+}
+
+// SessionEnd writes the summary table if one is requested.
+func (r *TableReporter) SessionEnd(total TotalMetrics, err error) {
+	mw := r.newWriter(r.w)
+	if r.Tree {
+		total.Tree(r.GroupBy).WriteTo(mw)
+		return
+	} else if r.Stats {
+		// every invocation is a sample, so only split the invocations into
+		// groups without aggregating them
+		total.split(r.GroupBy).Stats().WriteTo(mw)
+		return
+	} else if !r.Summary {
+		return
+	}
+
+	total = total.Group(r.GroupBy)
+	if !r.NoSort {
+		total = total.Sorted(r.SortKey, r.ReverseSort)
+	}
+	total.WriteScaled(mw, r.Scaling)
+}
+
+// MultiReporter returns a Reporter that sends everything to each of the
+// given reporters in turn. Diagnostics are only sent to the first reporter,
+// since reporters usually write them to standard error.
+func MultiReporter(reporters ...Reporter) Reporter {
+	return multiReporter(reporters)
+}
+
+type multiReporter []Reporter
+
+func (m multiReporter) SessionStart(info SessionInfo) {
+	for _, r := range m {
+		r.SessionStart(info)
+	}
+}
+
+func (m multiReporter) RegionEnter(ev RegionEvent) {
+	for _, r := range m {
+		r.RegionEnter(ev)
+	}
+}
+
+func (m multiReporter) RegionExit(ev RegionEvent, metrics Metrics) {
+	for _, r := range m {
+		r.RegionExit(ev, metrics)
+	}
+}
+
+func (m multiReporter) Diagnostic(msg string) {
+	if len(m) > 0 {
+		m[0].Diagnostic(msg)
+	}
+}
+
+func (m multiReporter) SessionEnd(total TotalMetrics, err error) {
+	for _, r := range m {
+		r.SessionEnd(total, err)
+	}
+}
@@ -0,0 +1,98 @@
+package perforator
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/zyedidia/perf"
+)
+
+// CountTogether reports whether the events can be counted at the same time
+// without multiplexing. It opens them as one group on the calling thread and
+// checks that the group runs for as long as it is enabled, so it accounts
+// for the counters of the PMU as well as those used by others, such as the
+// NMI watchdog.
+func CountTogether(configs []perf.Configurator, opts perf.Options) bool {
+	if len(configs) == 0 {
+		return true
+	}
+	// the group counts the thread that opened it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var g perf.Group
+	for i, c := range configs {
+		attr := &perf.Attr{
+			CountFormat: perf.CountFormat{
+				Enabled: true,
+				Running: true,
+			},
+			Options: opts,
+		}
+		c.Configure(attr)
+		attr.Options.Disabled = i == 0
+		g.Add(attr)
+	}
+	ev, err := g.Open(0, -1)
+	if err != nil {
+		logger.Printf("probe: %v\n", err)
+		return false
+	}
+	defer ev.Close()
+
+	if err := ev.Enable(); err != nil {
+		return false
+	}
+	// a group that does not fit is never scheduled, and one that competes
+	// with other events is rotated out within a few milliseconds
+	for start := time.Now(); time.Since(start) < 10*time.Millisecond; {
+	}
+	ev.Disable()
+
+	gc, err := ev.ReadGroupCount()
+	if err != nil {
+		return false
+	}
+	return gc.Running > 0 && gc.Running == gc.Enabled
+}
+
+// Passes splits the events into passes that can each be counted without
+// multiplexing, as decided by 'fit' (usually CountTogether). Groups are kept
+// whole, and each group and base event is added to the first pass that it
+// fits in.
+func (e Events) Passes(fit func([]perf.Configurator) bool) ([]Events, error) {
+	var passes []Events
+	var members [][]perf.Configurator
+	place := func(add []perf.Configurator) int {
+		for i, m := range members {
+			c := append(append([]perf.Configurator(nil), m...), add...)
+			if fit(c) {
+				members[i] = c
+				return i
+			}
+		}
+		passes = append(passes, Events{})
+		members = append(members, add)
+		return len(passes) - 1
+	}
+
+	for _, group := range e.Groups {
+		if !fit(group) {
+			return nil, fmt.Errorf("group %s cannot be counted without multiplexing", Events{Base: group}.Labels())
+		}
+		i := place(group)
+		passes[i].Groups = append(passes[i].Groups, group)
+	}
+	for _, c := range e.Base {
+		if !fit([]perf.Configurator{c}) {
+			return nil, fmt.Errorf("event %s cannot be counted", Events{Base: []perf.Configurator{c}}.Labels()[0])
+		}
+		i := place([]perf.Configurator{c})
+		passes[i].Base = append(passes[i].Base, c)
+	}
+	if len(passes) == 0 {
+		passes = append(passes, e)
+	}
+	return passes, nil
+}
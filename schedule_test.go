@@ -0,0 +1,94 @@
+package perforator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zyedidia/perf"
+)
+
+func TestPasses(t *testing.T) {
+	configs := func(names ...string) []perf.Configurator {
+		var cs []perf.Configurator
+		for _, name := range names {
+			c, err := NameToConfig(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cs = append(cs, c)
+		}
+		return cs
+	}
+	// two counters
+	fit := func(c []perf.Configurator) bool {
+		return len(c) <= 2
+	}
+
+	evs := Events{
+		Base:   configs("instructions", "branches", "cache-misses"),
+		Groups: [][]perf.Configurator{configs("cycles", "instructions")},
+	}
+	passes, err := evs.Passes(fit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, p := range passes {
+		got = append(got, p.Labels())
+	}
+	want := [][]string{
+		{"cpu-cycles", "instructions"},
+		{"instructions", "branch-instructions"},
+		{"cache-misses"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got passes %v, want %v", got, want)
+	}
+
+	evs.Groups = append(evs.Groups, configs("cycles", "instructions", "branches"))
+	if _, err := evs.Passes(fit); err == nil {
+		t.Error("expected an error for a group that does not fit")
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	inv := func(region string, i int, results ...Result) Invocation {
+		return Invocation{Region: region, Invocation: i, Elapsed: 10, Results: results}
+	}
+	a := &Record{
+		Version: RecordVersion,
+		Events:  []string{"cpu-cycles", "instructions"},
+		Invocations: []Invocation{
+			inv("f", 0, Result{Label: "cpu-cycles", Value: 1}, Result{Label: "instructions", Value: 2}),
+			inv("f", 1, Result{Label: "cpu-cycles", Value: 3}, Result{Label: "instructions", Value: 4}),
+			inv("g", 0, Result{Label: "cpu-cycles", Value: 5}, Result{Label: "instructions", Value: 6}),
+		},
+	}
+	b := &Record{
+		Version: RecordVersion,
+		Events:  []string{"branch-instructions"},
+		Invocations: []Invocation{
+			inv("g", 0, Result{Label: "branch-instructions", Value: 7}),
+			inv("f", 0, Result{Label: "branch-instructions", Value: 8}),
+		},
+	}
+
+	rec, dropped := MergeRecords([]*Record{a, b}, []string{"instructions", "branch-instructions", "cpu-cycles"})
+	if dropped != 1 {
+		t.Errorf("got %d dropped invocations, want 1", dropped)
+	}
+	if want := []string{"instructions", "branch-instructions", "cpu-cycles"}; !reflect.DeepEqual(rec.Events, want) {
+		t.Errorf("got events %v, want %v", rec.Events, want)
+	}
+	want := []Invocation{
+		inv("f", 0, Result{Label: "instructions", Value: 2}, Result{Label: "branch-instructions", Value: 8}, Result{Label: "cpu-cycles", Value: 1}),
+		inv("g", 0, Result{Label: "instructions", Value: 6}, Result{Label: "branch-instructions", Value: 7}, Result{Label: "cpu-cycles", Value: 5}),
+	}
+	if !reflect.DeepEqual(rec.Invocations, want) {
+		t.Errorf("got invocations %+v, want %+v", rec.Invocations, want)
+	}
+	// the records are not modified
+	if a.Invocations[0].Results[0].Label != "cpu-cycles" || len(a.Invocations) != 3 {
+		t.Error("merging modified a record")
+	}
+}
@@ -0,0 +1,610 @@
+package perforator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyedidia/perf"
+	"github.com/zyedidia/perforator/bininfo"
+	"github.com/zyedidia/perforator/utrace"
+)
+
+var (
+	ErrSessionStarted    = errors.New("session already started")
+	ErrSessionNotStarted = errors.New("session not started")
+
+	errNotElf = errors.New("not an executable")
+)
+
+// A Session traces a program as described by a Config. Tracing happens on a
+// dedicated goroutine that is locked to its OS thread, as required by ptrace,
+// so the methods of a Session may be called from any goroutine and callers do
+// not need to call runtime.LockOSThread.
+type Session struct {
+	cfg    Config
+	report Reporter
+
+	started bool
+	ctx     context.Context
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	// only accessed by the tracing goroutine until done is closed
+	total       TotalMetrics
+	err         error
+	invocations []int
+	// the index of the run of the target being traced
+	runIndex int
+
+	// the regions resolved in each program by executable path, and the
+	// index in cfg.Regions of every region resolved so far (event IDs index
+	// into this list)
+	images    map[string]*image
+	regionIds []int
+	matched   bool
+	// the names of the shared libraries that regions are in, and whether
+	// they have been loaded
+	libs map[string]bool
+}
+
+// NewSession creates a new session for the given configuration. The session
+// does nothing until Start is called.
+func NewSession(cfg Config) *Session {
+	if cfg.RangeInnerDelimiter == "" {
+		cfg.RangeInnerDelimiter = "-"
+	}
+	report := cfg.Reporter
+	if report == nil {
+		report = BaseReporter{}
+	}
+	return &Session{
+		cfg:    cfg,
+		report: report,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start begins tracing. It returns once the target has been started (or
+// attached to) and the region breakpoints have been inserted, or with an
+// error if that failed.
+func (s *Session) Start() error {
+	return s.StartContext(context.Background())
+}
+
+// StartContext is like Start but tracing stops when the context is done, as
+// if Close had been called. In that case Wait returns the metrics collected
+// so far along with the context's error.
+func (s *Session) StartContext(ctx context.Context) error {
+	if s.started {
+		return ErrSessionStarted
+	}
+	if s.cfg.Pid != 0 && s.cfg.Repeat > 1 {
+		return errors.New("cannot repeat when attaching to a process")
+	}
+	if s.cfg.Binary != "" && !s.cfg.FollowExec {
+		return errors.New("a binary filter requires following exec")
+	}
+	s.started = true
+	s.ctx = ctx
+
+	ready := make(chan error, 1)
+	go s.run(ready)
+	return <-ready
+}
+
+// Wait blocks until tracing has finished and returns all metrics that were
+// collected.
+func (s *Session) Wait() (TotalMetrics, error) {
+	if !s.started {
+		return TotalMetrics{}, ErrSessionNotStarted
+	}
+	<-s.done
+	return s.total, s.err
+}
+
+// Close stops tracing if it is still in progress. All breakpoints are
+// removed and the target is detached and left running. Close waits for
+// tracing to stop and returns any error that occurred while tracing. The
+// metrics collected so far remain available through Wait.
+func (s *Session) Close() error {
+	if !s.started {
+		return nil
+	}
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return s.err
+}
+
+func (s *Session) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	case <-s.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// run is the body of the tracing goroutine. The result of starting the first
+// program is sent on 'ready'.
+func (s *Session) run(ready chan<- error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer close(s.done)
+
+	s.total = make(TotalMetrics, 0)
+	s.invocations = make([]int, len(s.cfg.Regions))
+	s.images = make(map[string]*image)
+	s.libs = make(map[string]bool)
+	for _, spec := range s.cfg.Regions {
+		if lib, _ := splitLibrary(spec); lib != "" {
+			s.libs[lib] = false
+		}
+	}
+
+	var img *image
+	var buildID string
+	bin, path, err := s.open()
+	if err != nil && s.cfg.FollowExec && errors.Is(err, errNotElf) {
+		// the target may be a script, in which case the regions can only be
+		// found in the programs that it executes
+		logger.Printf("%s: %v\n", path, err)
+		img, err = &image{s: s}, nil
+		s.images[realpath(path)] = img
+	} else if err != nil {
+		s.err = err
+		ready <- err
+		return
+	} else {
+		// the regions of the original program must be resolved first so
+		// that their IDs match their indices
+		img, err = s.image(realpath(path), bin)
+		buildID = bin.BuildID()
+	}
+	if err != nil {
+		s.err = err
+		ready <- err
+		return
+	}
+
+	repeat := s.cfg.Repeat
+	if repeat < 1 {
+		repeat = 1
+	}
+
+	names := make([]string, len(s.cfg.Regions))
+	for i := range names {
+		names[i] = s.cfg.regionName(i)
+	}
+	s.report.SessionStart(SessionInfo{
+		Binary:              path,
+		BuildID:             buildID,
+		Regions:             s.cfg.Regions,
+		Names:               names,
+		RangeInnerDelimiter: s.cfg.RangeInnerDelimiter,
+		Events:              s.cfg.Events.Labels(),
+		Formulas:            s.cfg.Formulas,
+		Repeat:              repeat,
+	})
+	defer func() {
+		if s.cfg.Binary != "" && !s.matched {
+			s.report.Diagnostic(fmt.Sprintf("no program matching %s was executed", s.cfg.Binary))
+		}
+		for _, lib := range sortedLibs(s.libs) {
+			s.report.Diagnostic(fmt.Sprintf("library %s was never loaded", lib))
+		}
+		s.report.SessionEnd(s.total, s.err)
+	}()
+
+	for i := 0; i < repeat; i++ {
+		logger.Printf("run %d/%d\n", i+1, repeat)
+		s.runIndex = i
+
+		prog, pid, err := s.launch(img)
+		if i == 0 {
+			ready <- err
+		}
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		err = s.trace(prog, pid)
+		if err != nil {
+			s.err = err
+			return
+		}
+		if s.stopped() {
+			s.err = s.ctx.Err()
+			return
+		}
+	}
+}
+
+// open reads the binary of the target, and returns it along with its path.
+func (s *Session) open() (*bininfo.BinFile, string, error) {
+	if s.cfg.Pid != 0 {
+		bin, err := bininfo.FromPid(s.cfg.Pid)
+		if err != nil {
+			return nil, "", fmt.Errorf("elf-read: %w", err)
+		}
+		path, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", s.cfg.Pid))
+		return bin, path, nil
+	}
+
+	path, err := exec.LookPath(s.cfg.Target)
+	if err != nil {
+		return nil, "", fmt.Errorf("lookpath: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	bin, err := bininfo.Read(f, f.Name())
+	if err != nil {
+		return nil, path, fmt.Errorf("elf-read: %w: %v", errNotElf, err)
+	}
+	return bin, path, nil
+}
+
+// launch starts the target, or attaches to it, and traces the regions of its
+// image.
+func (s *Session) launch(img *image) (*utrace.Program, int, error) {
+	var prog *utrace.Program
+	pid := s.cfg.Pid
+	if pid != 0 {
+		var err error
+		prog, err = utrace.AttachProgram(img, pid, img.regions)
+		if err != nil {
+			return nil, 0, fmt.Errorf("attach: %w", err)
+		}
+	} else {
+		var err error
+		prog, pid, err = utrace.NewProgram(img, s.cfg.Target, s.cfg.Args, img.regions)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if s.cfg.FollowExec {
+		prog.FollowExec(s.exec)
+	}
+	return prog, pid, nil
+}
+
+// trace runs the main tracing loop for a program until it finishes or the
+// session is closed.
+func (s *Session) trace(prog *utrace.Program, pid int) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.stop:
+			prog.Interrupt()
+		case <-s.ctx.Done():
+			prog.Interrupt()
+		case <-done:
+		}
+	}()
+
+	fa := &perf.Attr{
+		CountFormat: perf.CountFormat{
+			Enabled: true,
+			Running: true,
+		},
+		Options: s.cfg.Options,
+	}
+	fa.Options.Disabled = true
+
+	events := s.cfg.Events
+	base := make([]*perf.Attr, len(events.Base))
+	for i, c := range events.Base {
+		attr := *fa
+		c.Configure(&attr)
+		base[i] = &attr
+	}
+	groups := make([][]*perf.Attr, len(events.Groups))
+	for i, group := range events.Groups {
+		for _, c := range group {
+			attr := *fa
+			c.Configure(&attr)
+			groups[i] = append(groups[i], &attr)
+		}
+	}
+
+	threads := make(map[int]*thread)
+	// with the process scope every thread is counted by the same counters
+	var shared *counting
+	var sum *SumProfiler
+	if s.cfg.Scope == ScopeProcess {
+		sum = &SumProfiler{}
+		shared = &counting{profiler: sum}
+		if s.cfg.Counters == CountersAlways {
+			sum.Enable()
+		}
+	}
+	defer func() {
+		if shared != nil {
+			shared.close()
+			return
+		}
+		for _, t := range threads {
+			t.close()
+		}
+	}()
+
+	newThread := func(tid int) (*thread, error) {
+		prof, err := makeProfiler(tid, base, groups)
+		if err != nil {
+			return nil, err
+		}
+		t := &thread{
+			pid:      tgid(tid),
+			comm:     comm(tid),
+			counting: shared,
+		}
+		threads[tid] = t
+		if shared != nil {
+			// the new thread is counted from now on if the process is
+			// being counted
+			return t, sum.Add(prof)
+		}
+		t.counting = &counting{profiler: prof}
+		if s.cfg.Counters == CountersAlways {
+			logger.Printf("%d: Profiler enabled\n", tid)
+			if err := prof.Enable(); err != nil {
+				return nil, err
+			}
+		}
+		return t, nil
+	}
+
+	// every thread is counted from the moment it is traced, since threads
+	// that never hit a breakpoint are not returned by Wait (which matters
+	// with ScopeProcess)
+	for _, tid := range append([]int{pid}, prog.Threads()...) {
+		if _, ok := threads[tid]; ok {
+			continue
+		}
+		if _, err := newThread(tid); err != nil {
+			prog.Detach()
+			return err
+		}
+	}
+
+	for {
+		var ws utrace.Status
+
+		p, evs, err := prog.Wait(&ws)
+		if err == utrace.ErrFinishedTrace {
+			break
+		} else if err == utrace.ErrInterrupted {
+			logger.Printf("tracing interrupted, detaching\n")
+			err = prog.Detach()
+			if err != nil {
+				return fmt.Errorf("detach: %w", err)
+			}
+			s.report.Diagnostic("tracing stopped, detached from the target")
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("wait: %w", err)
+		}
+
+		if tid := ws.Created(); tid != 0 {
+			if _, ok := threads[tid]; !ok {
+				if _, err := newThread(tid); err != nil {
+					return err
+				}
+			}
+		}
+		t, ok := threads[p.Pid()]
+		if !ok {
+			t, err = newThread(p.Pid())
+			if err != nil {
+				return err
+			}
+		}
+		prof := t.profiler
+
+		for _, ev := range evs {
+			if ev.Depth > 0 && s.cfg.Recursion == RecursionOuter {
+				continue
+			}
+
+			id := s.regionIds[ev.Id]
+			name := s.cfg.regionName(id)
+			switch ev.State {
+			case utrace.RegionStart:
+				logger.Printf("%d: Region %d entered (depth %d)\n", p.Pid(), ev.Id, ev.Depth)
+				f := frame{
+					region:     ev.Id,
+					invocation: s.invocations[id],
+					start:      time.Now(),
+					stack:      t.names(),
+				}
+				s.invocations[id]++
+				// threads are often named after they are created, so
+				// refresh the name each time a region is entered
+				t.comm = comm(p.Pid())
+				s.report.RegionEnter(RegionEvent{
+					Region:     name,
+					Run:        s.runIndex,
+					Pid:        t.pid,
+					Tid:        p.Pid(),
+					Comm:       t.comm,
+					Invocation: f.invocation,
+					Depth:      ev.Depth,
+					Stack:      f.stack,
+					Start:      f.start,
+				})
+				if len(t.frames) == 0 && s.cfg.Counters == CountersRegion {
+					logger.Printf("%d: Profiler enabled\n", p.Pid())
+					prof.Disable()
+					prof.Reset()
+					prof.Enable()
+				} else {
+					// the profiler keeps running for the enclosing
+					// invocations (or always), so measure from a
+					// snapshot
+					f.base = prof.Metrics()
+				}
+				t.frames = append(t.frames, f)
+				t.stack = append(t.stack, name)
+			case utrace.RegionEnd:
+				f, ok := t.pop(ev.Id)
+				if !ok {
+					continue
+				}
+
+				if len(t.frames) == 0 && s.cfg.Counters == CountersRegion {
+					prof.Disable()
+					logger.Printf("%d: Profiler disabled\n", p.Pid())
+				}
+				end := time.Now()
+				logger.Printf("%d: Region %d exited (depth %d)\n", p.Pid(), ev.Id, ev.Depth)
+				nm := NamedMetrics{
+					Metrics: prof.Metrics().sub(f.base).derive(s.cfg.Formulas),
+					Name:    name,
+					Run:     s.runIndex,
+					Pid:     t.pid,
+					Tid:     p.Pid(),
+					Comm:    t.comm,
+					Depth:   ev.Depth,
+					Stack:   f.stack,
+				}
+				s.total = append(s.total, nm)
+				s.report.RegionExit(RegionEvent{
+					Region:     name,
+					Run:        s.runIndex,
+					Pid:        t.pid,
+					Tid:        p.Pid(),
+					Comm:       t.comm,
+					Invocation: f.invocation,
+					Depth:      ev.Depth,
+					Stack:      f.stack,
+					Start:      f.start,
+					End:        end,
+				}, nm.Metrics)
+			}
+		}
+
+		err = prog.Continue(p, ws)
+		if err != nil {
+			return fmt.Errorf("trace-continue: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// A thread is a traced thread and the counters that measure the regions that
+// it executes.
+type thread struct {
+	pid  int
+	comm string
+	*counting
+}
+
+// A counting holds a profiler and the state of the regions that it measures.
+// A single profiler measures all regions of a thread (or of the whole process
+// with ScopeProcess), so that nested regions are not multiplexed with each
+// other.
+type counting struct {
+	profiler Profiler
+	// the active invocations of all regions, innermost last
+	frames []frame
+	// the names of the regions of the active invocations
+	stack []string
+}
+
+// A frame is an active invocation of a region.
+type frame struct {
+	region     int
+	invocation int
+	start      time.Time
+	// the names of the enclosing regions when the invocation began
+	stack []string
+	// the metrics when a nested invocation began
+	base Metrics
+}
+
+// names returns the names of the regions that are being executed, outermost
+// first.
+func (c *counting) names() []string {
+	return append([]string(nil), c.stack...)
+}
+
+// pop removes the innermost active invocation of the region with event ID
+// 'id'. Regions given as address ranges may overlap without being nested, so
+// it is not necessarily the innermost invocation of all regions.
+func (c *counting) pop(id int) (frame, bool) {
+	for i := len(c.frames) - 1; i >= 0; i-- {
+		if c.frames[i].region == id {
+			f := c.frames[i]
+			c.frames = append(c.frames[:i], c.frames[i+1:]...)
+			c.stack = append(c.stack[:i], c.stack[i+1:]...)
+			return f, true
+		}
+	}
+	return frame{}, false
+}
+
+func (c *counting) close() {
+	c.profiler.Close()
+}
+
+// tgid returns the thread group ID (the process ID) of a thread.
+func tgid(tid int) int {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return tid
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Tgid:") {
+			pid, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Tgid:")))
+			if err == nil {
+				return pid
+			}
+		}
+	}
+	return tid
+}
+
+// sortedLibs returns the libraries that have not been loaded, in order.
+func sortedLibs(libs map[string]bool) []string {
+	var names []string
+	for name, loaded := range libs {
+		if !loaded {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// comm returns the name of a thread, or an empty string if it cannot be read.
+func comm(tid int) string {
+	name, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", tid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(name))
+}
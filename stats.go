@@ -0,0 +1,343 @@
+package perforator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// A Summary describes the distribution of a set of samples.
+type Summary struct {
+	N      int
+	Mean   float64
+	Stddev float64
+	Min    float64
+	Max    float64
+	Median float64
+	// CILow and CIHigh are the bounds of the 95% confidence interval for the
+	// mean, computed with Student's t-distribution.
+	CILow  float64
+	CIHigh float64
+}
+
+// Summarize computes summary statistics for the given samples. The standard
+// deviation is the sample standard deviation, so it (and the confidence
+// interval) is zero if there are fewer than two samples.
+func Summarize(samples []float64) Summary {
+	n := len(samples)
+	if n == 0 {
+		return Summary{}
+	}
+
+	sorted := make([]float64, n)
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(n)
+
+	var median float64
+	if n%2 == 1 {
+		median = sorted[n/2]
+	} else {
+		median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	s := Summary{
+		N:      n,
+		Mean:   mean,
+		Min:    sorted[0],
+		Max:    sorted[n-1],
+		Median: median,
+		CILow:  mean,
+		CIHigh: mean,
+	}
+
+	if n < 2 {
+		return s
+	}
+
+	var sqdiff float64
+	for _, v := range sorted {
+		sqdiff += (v - mean) * (v - mean)
+	}
+	s.Stddev = math.Sqrt(sqdiff / float64(n-1))
+
+	margin := tQuantile975(n-1) * s.Stddev / math.Sqrt(float64(n))
+	s.CILow = mean - margin
+	s.CIHigh = mean + margin
+
+	return s
+}
+
+// two-sided 95% critical values of Student's t-distribution for 1 to 30
+// degrees of freedom
+var tTable975 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// tQuantile975 returns the 97.5th percentile of Student's t-distribution with
+// the given degrees of freedom.
+func tQuantile975(df int) float64 {
+	if df < 1 {
+		return math.Inf(1)
+	}
+	if df <= len(tTable975) {
+		return tTable975[df-1]
+	}
+	// Cornish-Fisher expansion around the normal quantile, which is accurate
+	// to well within the precision of the table for df > 30.
+	const z = 1.959964
+	d := float64(df)
+	z3, z5 := z*z*z, z*z*z*z*z
+	return z + (z3+z)/(4*d) + (5*z5+16*z3+3*z)/(96*d*d)
+}
+
+// EventStats is the summary of a single event over all invocations of a
+// region.
+type EventStats struct {
+	Summary
+	Label string
+}
+
+// RegionStats contains the statistics of every event for one region.
+type RegionStats struct {
+	Name   string
+	Events []EventStats
+}
+
+// TotalStats is a list of statistics for each region.
+type TotalStats []RegionStats
+
+// regionSamples holds the samples of every event for one region, with the
+// events in the order in which they first appear. A derived metric may have
+// no samples if its formula could never be computed.
+type regionSamples struct {
+	name    string
+	labels  []string
+	values  map[string][]float64
+	runs    map[string][]int // the run of each sample
+	derived map[string]bool
+}
+
+// samples collects the value of every event in each invocation of a region.
+// Regions are listed in the order in which they first appear. The elapsed
+// time is included as the "time-elapsed" event, measured in nanoseconds.
+func (t TotalMetrics) samples() []*regionSamples {
+	var regions []*regionSamples
+	index := make(map[string]*regionSamples)
+	for _, m := range t {
+		s, ok := index[m.Name]
+		if !ok {
+			s = &regionSamples{
+				name:    m.Name,
+				values:  make(map[string][]float64),
+				runs:    make(map[string][]int),
+				derived: make(map[string]bool),
+			}
+			index[m.Name] = s
+			regions = append(regions, s)
+		}
+		label := func(label string) {
+			if _, ok := s.values[label]; !ok {
+				s.labels = append(s.labels, label)
+				s.values[label] = nil
+			}
+		}
+		add := func(l string, v float64) {
+			label(l)
+			s.values[l] = append(s.values[l], v)
+			s.runs[l] = append(s.runs[l], m.Run)
+		}
+		for _, r := range m.Results {
+			label(r.Label)
+			// an event that was not counted is not a sample
+			if r.Counted() {
+				add(r.Label, float64(r.Value))
+			}
+		}
+		add("time-elapsed", float64(m.Elapsed))
+		for _, d := range m.Derived {
+			label(d.Label)
+			s.derived[d.Label] = true
+			// a division by zero is not a sample
+			if !math.IsNaN(d.Value) {
+				add(d.Label, d.Value)
+			}
+		}
+	}
+	return regions
+}
+
+// Stats computes statistics for each region and event, where each invocation
+// of a region is one sample. Regions are listed in the order in which they
+// first appear. The elapsed time is included as the "time-elapsed" event,
+// measured in nanoseconds.
+func (t TotalMetrics) Stats() TotalStats {
+	regions := t.samples()
+	stats := make(TotalStats, 0, len(regions))
+	for _, s := range regions {
+		rs := RegionStats{
+			Name: s.name,
+		}
+		for _, label := range s.labels {
+			if len(s.values[label]) == 0 {
+				continue
+			}
+			rs.Events = append(rs.Events, EventStats{
+				Summary: Summarize(s.values[label]),
+				Label:   label,
+			})
+		}
+		stats = append(stats, rs)
+	}
+	return stats
+}
+
+func formatStat(label string, v float64) string {
+	if label == "time-elapsed" {
+		return time.Duration(v).String()
+	}
+	return fmt.Sprintf("%.2f", v)
+}
+
+// WriteTo pretty-prints the statistics and writes the result to a
+// MetricsWriter, with one row for each region and event.
+func (t TotalStats) WriteTo(table MetricsWriter) {
+	table.SetHeader([]string{"region", "event", "n", "mean", "stddev", "min", "median", "max", "95% ci"})
+
+	for _, rs := range t {
+		for _, es := range rs.Events {
+			table.Append([]string{
+				rs.Name,
+				es.Label,
+				fmt.Sprintf("%d", es.N),
+				formatStat(es.Label, es.Mean),
+				formatStat(es.Label, es.Stddev),
+				formatStat(es.Label, es.Min),
+				formatStat(es.Label, es.Median),
+				formatStat(es.Label, es.Max),
+				fmt.Sprintf("%s - %s", formatStat(es.Label, es.CILow), formatStat(es.Label, es.CIHigh)),
+			})
+		}
+	}
+
+	table.Render()
+}
+
+// exactLimit is the largest sample size for which MannWhitney computes the
+// exact distribution of U.
+const exactLimit = 50
+
+// MannWhitney returns the two-sided p-value of the Mann-Whitney U test of
+// the hypothesis that the samples x and y come from the same distribution.
+// The p-value is exact for small samples without ties, and otherwise uses
+// the normal approximation with a correction for ties. It is NaN if either
+// set of samples is empty.
+func MannWhitney(x, y []float64) float64 {
+	n1, n2 := len(x), len(y)
+	if n1 == 0 || n2 == 0 {
+		return math.NaN()
+	}
+
+	type sample struct {
+		v     float64
+		fromX bool
+	}
+	all := make([]sample, 0, n1+n2)
+	for _, v := range x {
+		all = append(all, sample{v, true})
+	}
+	for _, v := range y {
+		all = append(all, sample{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].v < all[j].v
+	})
+
+	// tied values get the mean of their ranks
+	var r1, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromX {
+				r1 += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	u := r1 - float64(n1*(n1+1))/2
+	if other := float64(n1*n2) - u; other < u {
+		u = other
+	}
+
+	var p float64
+	if ties == 0 && n1 <= exactLimit && n2 <= exactLimit {
+		p = 2 * mannWhitneyCDF(n1, n2, int(u))
+	} else {
+		n := float64(n1 + n2)
+		mu := float64(n1*n2) / 2
+		sigma := math.Sqrt(float64(n1*n2) / 12 * (n + 1 - ties/(n*(n-1))))
+		if sigma == 0 {
+			return 1
+		}
+		// with a continuity correction
+		z := (u - mu + 0.5) / sigma
+		p = math.Erfc(-z / math.Sqrt2)
+	}
+	return math.Min(p, 1)
+}
+
+// mannWhitneyCDF returns the probability that U is at most u for samples of
+// sizes n1 and n2 without ties.
+func mannWhitneyCDF(n1, n2, u int) float64 {
+	// counts[j][k] is the number of orderings of i samples of x and j
+	// samples of y in which k pairs have the sample of y first; the last
+	// sample is either from x, which follows all j samples of y, or from y
+	counts := make([][]float64, n2+1)
+	prev := make([][]float64, n2+1)
+	for j := range counts {
+		counts[j] = make([]float64, u+1)
+		prev[j] = make([]float64, u+1)
+		prev[j][0] = 1
+	}
+	for i := 1; i <= n1; i++ {
+		for j := 0; j <= n2; j++ {
+			for k := 0; k <= u; k++ {
+				var c float64
+				if k >= j {
+					c = prev[j][k-j]
+				}
+				if j > 0 {
+					c += counts[j-1][k]
+				}
+				counts[j][k] = c
+			}
+		}
+		prev, counts = counts, prev
+	}
+
+	var n float64
+	for _, c := range prev[n2] {
+		n += c
+	}
+	// the total number of orderings is (n1+n2) choose n1
+	total := 1.0
+	for i := 1; i <= n1; i++ {
+		total = total * float64(n2+i) / float64(i)
+	}
+	return n / total
+}
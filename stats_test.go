@@ -0,0 +1,104 @@
+package perforator
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-3*math.Max(1, math.Abs(b))
+}
+
+func TestSummarize(t *testing.T) {
+	s := Summarize([]float64{2, 4, 4, 4, 5, 5, 7, 9})
+
+	if s.N != 8 || s.Min != 2 || s.Max != 9 {
+		t.Errorf("unexpected n/min/max: %+v", s)
+	}
+	if !approx(s.Mean, 5) || !approx(s.Median, 4.5) {
+		t.Errorf("unexpected mean/median: %+v", s)
+	}
+	if !approx(s.Stddev, 2.138) {
+		t.Errorf("unexpected stddev: %f", s.Stddev)
+	}
+	// t(0.975, 7) = 2.365
+	margin := 2.365 * 2.138 / math.Sqrt(8)
+	if !approx(s.CILow, 5-margin) || !approx(s.CIHigh, 5+margin) {
+		t.Errorf("unexpected confidence interval: [%f, %f]", s.CILow, s.CIHigh)
+	}
+
+	one := Summarize([]float64{3})
+	if one.Stddev != 0 || one.CILow != 3 || one.CIHigh != 3 {
+		t.Errorf("unexpected single-sample summary: %+v", one)
+	}
+}
+
+func TestTQuantile(t *testing.T) {
+	// the expansion should agree with the table at the boundary and tend to
+	// the normal quantile
+	if !approx(tQuantile975(31), 2.040) {
+		t.Errorf("unexpected t(31): %f", tQuantile975(31))
+	}
+	if !approx(tQuantile975(1000), 1.962) {
+		t.Errorf("unexpected t(1000): %f", tQuantile975(1000))
+	}
+}
+
+func TestStats(t *testing.T) {
+	total := TotalMetrics{
+		{Name: "a", Metrics: Metrics{Results: []Result{{Label: "instructions", Value: 10}}, Elapsed: time.Second}},
+		{Name: "b", Metrics: Metrics{Results: []Result{{Label: "instructions", Value: 1}}, Elapsed: time.Second}},
+		{Name: "a", Metrics: Metrics{Results: []Result{{Label: "instructions", Value: 20}}, Elapsed: 3 * time.Second}},
+	}
+
+	stats := total.Stats()
+	if len(stats) != 2 || stats[0].Name != "a" || stats[1].Name != "b" {
+		t.Fatalf("unexpected regions: %+v", stats)
+	}
+	a := stats[0]
+	if len(a.Events) != 2 || a.Events[0].Label != "instructions" || a.Events[1].Label != "time-elapsed" {
+		t.Fatalf("unexpected events: %+v", a.Events)
+	}
+	if a.Events[0].N != 2 || !approx(a.Events[0].Mean, 15) {
+		t.Errorf("unexpected instructions summary: %+v", a.Events[0].Summary)
+	}
+	if !approx(a.Events[1].Mean, float64(2*time.Second)) {
+		t.Errorf("unexpected elapsed summary: %+v", a.Events[1].Summary)
+	}
+}
+
+func TestMannWhitney(t *testing.T) {
+	seq := func(from, to float64) []float64 {
+		var s []float64
+		for v := from; v <= to; v++ {
+			s = append(s, v)
+		}
+		return s
+	}
+	check := func(name string, x, y []float64, want float64) {
+		t.Helper()
+		if p := MannWhitney(x, y); !approx(p, want) {
+			t.Errorf("%s: got p=%f, want %f", name, p, want)
+		}
+	}
+
+	// exact: 2 of the 20 orderings are at least as extreme
+	check("separated 3+3", seq(1, 3), seq(4, 6), 0.1)
+	check("separated 5+5", seq(1, 5), seq(6, 10), 2.0/252)
+	check("interleaved 3+3", []float64{1, 3, 5}, []float64{2, 4, 6}, 0.7)
+	check("symmetric", seq(6, 10), seq(1, 5), 2.0/252)
+
+	// normal approximation
+	check("identical", []float64{5, 5, 5}, []float64{5, 5, 5}, 1)
+	if p := MannWhitney([]float64{1, 1, 2, 2, 3, 3}, []float64{7, 7, 8, 8, 9, 9}); p > 0.01 {
+		t.Errorf("ties: expected a significant difference, got p=%f", p)
+	}
+	if p := MannWhitney(seq(1, 60), seq(1, 60)); p < 0.9 {
+		t.Errorf("large: expected no difference, got p=%f", p)
+	}
+
+	if !math.IsNaN(MannWhitney(nil, seq(1, 3))) {
+		t.Error("expected NaN without samples")
+	}
+}
@@ -0,0 +1,249 @@
+package perforator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zyedidia/perf"
+)
+
+// sysfsRoot is the directory where sysfs is mounted.
+var sysfsRoot = "/sys"
+
+// SetSysfsRoot sets the directory where sysfs is mounted, which is /sys by
+// default. PMUs and tracepoints are found below this directory, so a copy of
+// the tree may be used instead of the real one.
+func SetSysfsRoot(root string) {
+	sysfsRoot = root
+}
+
+// pmuDir returns the directory where the kernel lists the PMUs.
+func pmuDir() string {
+	return filepath.Join(sysfsRoot, "bus", "event_source", "devices")
+}
+
+// tracingDir returns the directory of the tracing filesystem. It is mounted
+// at /sys/kernel/tracing on recent kernels, and in debugfs otherwise.
+func tracingDir() string {
+	for _, dir := range []string{"kernel/tracing", "kernel/debug/tracing"} {
+		path := filepath.Join(sysfsRoot, dir)
+		if _, err := os.Stat(filepath.Join(path, "available_events")); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(sysfsRoot, "kernel/debug/tracing")
+}
+
+// readUint reads a file containing a decimal number.
+func readUint(path string, bits int) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, bits)
+}
+
+// tracepoint resolves a tracepoint written as subsystem:event.
+func tracepoint(name string) (rawEvent, error) {
+	parts := strings.SplitN(name, ":", 2)
+	id, err := readUint(filepath.Join(tracingDir(), "events", parts[0], parts[1], "id"), 64)
+	if err != nil {
+		return rawEvent{}, fmt.Errorf("not found: event %s", name)
+	}
+	return rawEvent{
+		typ:    perf.TracepointEvent,
+		config: [3]uint64{id},
+		label:  name,
+	}, nil
+}
+
+// A pmu is a performance monitoring unit of the kernel, such as the CPU's
+// core PMU, which has a type for perf_event_open, a format that describes how
+// the terms of an event are placed in the configs, and named events.
+type pmu struct {
+	name    string
+	typ     perf.EventType
+	formats map[string]string
+	events  map[string]*pmuEventInfo
+}
+
+// pmuEventInfo is an event named by a PMU, with the terms that select it and
+// how its count is converted to a value (for example to Joules).
+type pmuEventInfo struct {
+	terms string
+	unit  string
+	scale string
+}
+
+// readPMU reads the description of a PMU from sysfs.
+func readPMU(name string) (*pmu, error) {
+	dir := filepath.Join(pmuDir(), name)
+	typ, err := readUint(filepath.Join(dir, "type"), 32)
+	if err != nil {
+		return nil, fmt.Errorf("unknown PMU %s", name)
+	}
+	p := &pmu{
+		name:    name,
+		typ:     perf.EventType(typ),
+		formats: make(map[string]string),
+		events:  make(map[string]*pmuEventInfo),
+	}
+
+	read := func(path string) string {
+		b, _ := ioutil.ReadFile(path)
+		return strings.TrimSpace(string(b))
+	}
+	formats, _ := ioutil.ReadDir(filepath.Join(dir, "format"))
+	for _, f := range formats {
+		p.formats[f.Name()] = read(filepath.Join(dir, "format", f.Name()))
+	}
+	events, _ := ioutil.ReadDir(filepath.Join(dir, "events"))
+	for _, f := range events {
+		if strings.Contains(f.Name(), ".") {
+			// .unit, .scale, .per-pkg and .snapshot describe other files
+			continue
+		}
+		path := filepath.Join(dir, "events", f.Name())
+		p.events[f.Name()] = &pmuEventInfo{
+			terms: read(path),
+			unit:  read(path + ".unit"),
+			scale: read(path + ".scale"),
+		}
+	}
+	return p, nil
+}
+
+// pmus returns every PMU in sysfs, sorted by name.
+func pmus() []*pmu {
+	dirs, _ := ioutil.ReadDir(pmuDir())
+	var list []*pmu
+	for _, d := range dirs {
+		if p, err := readPMU(d.Name()); err == nil {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// pmuEvent parses an event of a PMU written as pmu/term=value,.../. The
+// terms config, config1 and config2 set the configs directly and name sets
+// the label. Other terms are placed in the configs as described by the
+// format of the PMU, and a term without a value is either an event named by
+// the PMU, whose terms are used, or set to 1.
+func pmuEvent(spec string) (rawEvent, error) {
+	parts := strings.SplitN(strings.TrimSuffix(spec, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return rawEvent{}, fmt.Errorf("event %s: expected pmu/terms/", spec)
+	}
+	p, err := readPMU(parts[0])
+	if err != nil {
+		return rawEvent{}, fmt.Errorf("event %s: %w", spec, err)
+	}
+	ev := rawEvent{
+		typ:   p.typ,
+		label: spec,
+	}
+	if err := p.setTerms(&ev, parts[1], true); err != nil {
+		return rawEvent{}, fmt.Errorf("event %s: %w", spec, err)
+	}
+	return ev, nil
+}
+
+// setTerms sets the configs of an event from a comma-separated list of
+// terms. Named events are only expanded if 'named' is set, so that they
+// cannot refer to each other.
+func (p *pmu) setTerms(ev *rawEvent, terms string, named bool) error {
+	for _, term := range strings.Split(terms, ",") {
+		if term == "" {
+			continue
+		}
+		key, value := term, "1"
+		if i := strings.Index(term, "="); i >= 0 {
+			key, value = term[:i], term[i+1:]
+		} else if info, ok := p.events[key]; ok && named {
+			if err := p.setTerms(ev, info.terms, false); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			continue
+		}
+		if key == "name" {
+			ev.label = value
+			continue
+		}
+		v, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", key, value)
+		}
+		switch key {
+		case "config":
+			ev.config[0] = v
+			continue
+		case "config1":
+			ev.config[1] = v
+			continue
+		case "config2":
+			ev.config[2] = v
+			continue
+		}
+		format, ok := p.formats[key]
+		if !ok {
+			return fmt.Errorf("unknown term %s", key)
+		}
+		if err := ev.setField(format, v); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// setField places a value in the configs according to a PMU format such as
+// 'config:0-7' or 'config1:0-3,8-11', where the bits of the value fill the
+// ranges in order.
+func (e *rawEvent) setField(format string, v uint64) error {
+	i := strings.Index(format, ":")
+	if i < 0 {
+		return fmt.Errorf("invalid format %q", format)
+	}
+	var config *uint64
+	switch format[:i] {
+	case "config":
+		config = &e.config[0]
+	case "config1":
+		config = &e.config[1]
+	case "config2":
+		config = &e.config[2]
+	default:
+		return fmt.Errorf("invalid format %q", format)
+	}
+
+	var used uint
+	for _, r := range strings.Split(format[i+1:], ",") {
+		lo, hi := r, r
+		if j := strings.Index(r, "-"); j >= 0 {
+			lo, hi = r[:j], r[j+1:]
+		}
+		l, err1 := strconv.ParseUint(lo, 10, 6)
+		h, err2 := strconv.ParseUint(hi, 10, 6)
+		if err1 != nil || err2 != nil || h < l {
+			return fmt.Errorf("invalid format %q", format)
+		}
+		for b := l; b <= h; b++ {
+			if v>>used&1 != 0 {
+				*config |= 1 << b
+			}
+			used++
+		}
+	}
+	if used < 64 && v>>used != 0 {
+		return fmt.Errorf("value 0x%x does not fit in %d bits", v, used)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+#include <dlfcn.h>
+#include <stdio.h>
+
+// The library is usually loaded at the same address each time.
+int main() {
+    for (int i = 0; i < 4; i++) {
+        void* lib = dlopen("./test/libwork.so", RTLD_NOW);
+        if (!lib) {
+            fprintf(stderr, "%s\n", dlerror());
+            return 1;
+        }
+        if (i < 3) {
+            int (*work)(int) = dlsym(lib, "work");
+            work(1000000);
+        } else {
+            void (*begin)(void) = dlsym(lib, "begin");
+            begin();
+        }
+        dlclose(lib);
+    }
+    return 0;
+}
@@ -0,0 +1,18 @@
+// work is profiled in a library that is loaded and unloaded several times.
+int work(int n) {
+    volatile int sum = 0;
+    for (int i = 0; i < n; i++) {
+        sum += i;
+    }
+    return sum;
+}
+
+// The range from begin to end is still open when the library is unloaded,
+// since end is never called.
+void begin(void) {
+    work(1000000);
+}
+
+void end(void) {
+    work(1);
+}
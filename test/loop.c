@@ -0,0 +1,17 @@
+#include <unistd.h>
+
+// The region is entered every 25ms for about a second, so the program is
+// still running after tracing stops.
+int __attribute__ ((noinline)) region(int i) {
+    volatile int x = i;
+    return x + 1;
+}
+
+int main() {
+    int n = 0;
+    for (int i = 0; i < 40; i++) {
+        n = region(n);
+        usleep(25000);
+    }
+    return n != 40;
+}
@@ -0,0 +1,15 @@
+// Each call to depth recurses n times before returning.
+int __attribute__ ((noinline)) depth(int n) {
+    if (n == 0) {
+        return 0;
+    }
+    return 1 + depth(n - 1);
+}
+
+int main() {
+    int d = 0;
+    for (int i = 0; i < 2; i++) {
+        d += depth(4);
+    }
+    return d != 8;
+}
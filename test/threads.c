@@ -0,0 +1,31 @@
+#include <pthread.h>
+
+#define THREADS 4
+#define CALLS 25
+
+// Every thread enters the region repeatedly, often while other threads are
+// inside it.
+void __attribute__ ((noinline)) region() {
+    volatile long sum = 0;
+    for (long i = 0; i < 1000000; i++) {
+        sum += i;
+    }
+}
+
+static void* worker(void* arg) {
+    for (int i = 0; i < CALLS; i++) {
+        region();
+    }
+    return NULL;
+}
+
+int main() {
+    pthread_t t[THREADS];
+    for (int i = 0; i < THREADS; i++) {
+        pthread_create(&t[i], NULL, worker, NULL);
+    }
+    for (int i = 0; i < THREADS; i++) {
+        pthread_join(t[i], NULL);
+    }
+    return 0;
+}
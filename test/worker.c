@@ -0,0 +1,30 @@
+#include <pthread.h>
+#include <unistd.h>
+
+// The worker thread does all of the work of the region, but never enters it.
+static int fds[2];
+
+static void* worker(void* arg) {
+    char c;
+    read(fds[0], &c, 1);
+    volatile long sum = 0;
+    for (long i = 0; i < 50000000; i++) {
+        sum += i;
+    }
+    return NULL;
+}
+
+void __attribute__ ((noinline)) region(pthread_t t) {
+    write(fds[1], "x", 1);
+    pthread_join(t, NULL);
+}
+
+int main() {
+    pipe(fds);
+    pthread_t t;
+    pthread_create(&t, NULL, worker, NULL);
+    // leaves time to attach to the process
+    usleep(500000);
+    region(t);
+    return 0;
+}
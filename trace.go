@@ -0,0 +1,128 @@
+package perforator
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+)
+
+// A TraceReporter is a Reporter that writes a timeline of the session in the
+// Chrome Trace Event Format, which can be opened in Perfetto or
+// chrome://tracing. Every invocation of a region is a complete event on the
+// thread that executed it, with the results as arguments, so nested regions
+// appear as nested slices. The trace is written when the session ends.
+type TraceReporter struct {
+	BaseReporter
+
+	w      io.Writer
+	origin time.Time
+	events []traceEvent
+	// the threads and processes that have been named
+	threads map[int]bool
+	procs   map[int]bool
+	err     error
+}
+
+// traceEvent is an event in the Chrome Trace Event Format. Timestamps and
+// durations are in microseconds.
+type traceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   float64                `json:"ts"`
+	Dur  float64                `json:"dur"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// NewTraceReporter returns a reporter that writes a trace to w.
+func NewTraceReporter(w io.Writer) *TraceReporter {
+	return &TraceReporter{
+		w:       w,
+		threads: make(map[int]bool),
+		procs:   make(map[int]bool),
+	}
+}
+
+// Err returns the error that occurred while writing the trace, if any.
+func (r *TraceReporter) Err() error {
+	return r.err
+}
+
+// micros returns the time since the first invocation in microseconds.
+func (r *TraceReporter) micros(t time.Time) float64 {
+	if r.origin.IsZero() {
+		r.origin = t
+	}
+	return float64(t.Sub(r.origin)) / float64(time.Microsecond)
+}
+
+// RegionEnter names the thread and process of the invocation, if they have
+// not been named yet.
+func (r *TraceReporter) RegionEnter(ev RegionEvent) {
+	r.micros(ev.Start)
+	if !r.threads[ev.Tid] {
+		r.threads[ev.Tid] = true
+		r.events = append(r.events, traceEvent{
+			Name: "thread_name",
+			Ph:   "M",
+			Pid:  ev.Pid,
+			Tid:  ev.Tid,
+			Args: map[string]interface{}{"name": ev.Comm},
+		})
+	}
+	if ev.Tid == ev.Pid && !r.procs[ev.Pid] {
+		r.procs[ev.Pid] = true
+		r.events = append(r.events, traceEvent{
+			Name: "process_name",
+			Ph:   "M",
+			Pid:  ev.Pid,
+			Args: map[string]interface{}{"name": ev.Comm},
+		})
+	}
+}
+
+// RegionExit adds a complete event for the invocation.
+func (r *TraceReporter) RegionExit(ev RegionEvent, m Metrics) {
+	args := map[string]interface{}{
+		"invocation": ev.Invocation,
+	}
+	if ev.Depth > 0 {
+		args["depth"] = ev.Depth
+	}
+	for _, res := range m.Results {
+		args[res.Label] = res.Value
+	}
+	for _, d := range m.Derived {
+		// NaN cannot be written in JSON
+		if !math.IsNaN(d.Value) && !math.IsInf(d.Value, 0) {
+			args[d.Label] = d.Value
+		}
+	}
+
+	start := r.micros(ev.Start)
+	r.events = append(r.events, traceEvent{
+		Name: ev.Region,
+		Cat:  "region",
+		Ph:   "X",
+		Ts:   start,
+		Dur:  r.micros(ev.End) - start,
+		Pid:  ev.Pid,
+		Tid:  ev.Tid,
+		Args: args,
+	})
+}
+
+// SessionEnd writes the trace.
+func (r *TraceReporter) SessionEnd(total TotalMetrics, err error) {
+	events := r.events
+	if events == nil {
+		events = []traceEvent{}
+	}
+	r.err = json.NewEncoder(r.w).Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ns"})
+}
@@ -0,0 +1,82 @@
+package perforator
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTraceReporter(&buf)
+	var c collector
+	r := MultiReporter(tr, &c)
+
+	start := time.Unix(100, 0)
+	at := func(us int) time.Time {
+		return start.Add(time.Duration(us) * time.Microsecond)
+	}
+	outer := RegionEvent{Region: "outer", Pid: 10, Tid: 10, Comm: "main", Start: at(0)}
+	inner := RegionEvent{Region: "inner", Pid: 10, Tid: 10, Comm: "main", Start: at(10), Stack: []string{"outer"}}
+
+	r.SessionStart(SessionInfo{})
+	r.RegionEnter(outer)
+	r.RegionEnter(inner)
+	inner.End = at(30)
+	r.RegionExit(inner, Metrics{
+		Results: []Result{{Label: "instructions", Value: 5}},
+		Derived: []Derived{{Label: "ipc", Value: math.NaN()}},
+	})
+	outer.End = at(100)
+	r.RegionExit(outer, Metrics{Results: []Result{{Label: "instructions", Value: 20}}})
+	r.SessionEnd(nil, nil)
+	if tr.Err() != nil {
+		t.Fatal(tr.Err())
+	}
+	if len(c.exits) != 2 {
+		t.Errorf("expected every reporter to receive the exits, got %d", len(c.exits))
+	}
+
+	var trace struct {
+		TraceEvents []struct {
+			Name string
+			Ph   string
+			Ts   float64
+			Dur  float64
+			Pid  int
+			Tid  int
+			Args map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatalf("invalid trace: %v\n%s", err, buf.String())
+	}
+
+	var names, slices []string
+	for _, ev := range trace.TraceEvents {
+		switch ev.Ph {
+		case "M":
+			names = append(names, ev.Name)
+		case "X":
+			slices = append(slices, ev.Name)
+			if ev.Pid != 10 || ev.Tid != 10 {
+				t.Errorf("%s: unexpected pid/tid %d/%d", ev.Name, ev.Pid, ev.Tid)
+			}
+			want := map[string][2]float64{"inner": {10, 20}, "outer": {0, 100}}[ev.Name]
+			if ev.Ts != want[0] || ev.Dur != want[1] {
+				t.Errorf("%s: got ts=%v dur=%v, want %v", ev.Name, ev.Ts, ev.Dur, want)
+			}
+			if _, ok := ev.Args["instructions"]; !ok {
+				t.Errorf("%s: missing counter in %v", ev.Name, ev.Args)
+			}
+			if _, ok := ev.Args["ipc"]; ok {
+				t.Errorf("%s: NaN metric in %v", ev.Name, ev.Args)
+			}
+		}
+	}
+	if len(names) != 2 || len(slices) != 2 || slices[0] != "inner" {
+		t.Errorf("unexpected events: metadata %v, slices %v", names, slices)
+	}
+}
@@ -0,0 +1,153 @@
+package perforator
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// A TreeNode is a region in the nesting tree of regions. Its inclusive
+// metrics are the sum of all invocations of the region at this position in
+// the tree, and its exclusive metrics leave out the regions nested in it.
+type TreeNode struct {
+	Name      string
+	Calls     int
+	Inclusive Metrics
+	Exclusive Metrics
+	Children  []*TreeNode
+}
+
+// RegionTree is the list of regions that were not nested in another region,
+// each with the tree of regions nested in it.
+type RegionTree []*TreeNode
+
+// Tree builds the nesting tree of regions from the enclosing regions of every
+// invocation. With GroupThread or GroupProcess each thread or process has a
+// separate tree whose outermost regions are named as with Group, and
+// otherwise the invocations of all threads are merged.
+func (t TotalMetrics) Tree(by GroupBy) RegionTree {
+	root := &TreeNode{}
+	split := t.split(by)
+	for i, m := range t {
+		path := append(append([]string(nil), m.Stack...), m.Name)
+		path[0] += strings.TrimPrefix(split[i].Name, m.Name)
+
+		n := root
+		for _, name := range path {
+			n = n.child(name)
+		}
+		n.Calls++
+		n.Inclusive = n.Inclusive.add(m.Metrics)
+	}
+	root.exclusive()
+	return RegionTree(root.Children)
+}
+
+// child returns the child node with the given name, adding it if needed.
+func (n *TreeNode) child(name string) *TreeNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	c := &TreeNode{
+		Name: name,
+	}
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// exclusive computes the exclusive metrics of the node and its children.
+func (n *TreeNode) exclusive() {
+	var nested Metrics
+	for _, c := range n.Children {
+		c.exclusive()
+		nested = nested.add(c.Inclusive)
+	}
+	n.Inclusive = n.Inclusive.rederive()
+	n.Exclusive = n.Inclusive.sub(nested)
+	// an invocation that was still running when tracing stopped has no
+	// metrics, but the regions nested in it do
+	if n.Exclusive.Elapsed < 0 {
+		n.Exclusive.Elapsed = 0
+	}
+	n.Exclusive = n.Exclusive.rederive()
+}
+
+// WriteTo pretty-prints the tree and writes the result to a MetricsWriter,
+// with one row for each region and event. Nested regions are indented below
+// their parent, and the inclusive count of each event is shown as a
+// percentage of the parent's.
+func (t RegionTree) WriteTo(table MetricsWriter) {
+	table.SetHeader([]string{"region", "event", "calls", "inclusive", "exclusive", "% of parent"})
+	for _, n := range t {
+		n.writeTo(table, nil, 0)
+	}
+	table.Render()
+}
+
+func (n *TreeNode) writeTo(table MetricsWriter, parent *TreeNode, depth int) {
+	name := strings.Repeat("  ", depth) + n.Name
+	calls := fmt.Sprintf("%d", n.Calls)
+
+	percent := func(v, total float64) string {
+		if parent == nil || total == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.1f%%", 100*v/total)
+	}
+
+	for i, r := range n.Inclusive.Results {
+		var excl uint64
+		if i < len(n.Exclusive.Results) {
+			excl = n.Exclusive.Results[i].Value
+		}
+		var total uint64
+		if parent != nil && i < len(parent.Inclusive.Results) {
+			total = parent.Inclusive.Results[i].Value
+		}
+		if !r.Counted() {
+			table.Append([]string{name, r.Label, calls, "<not counted>", "", ""})
+			continue
+		}
+		table.Append([]string{
+			name,
+			r.Label,
+			calls,
+			fmt.Sprintf("%d", r.Value),
+			fmt.Sprintf("%d", excl),
+			percent(float64(r.Value), float64(total)),
+		})
+	}
+	var total time.Duration
+	if parent != nil {
+		total = parent.Inclusive.Elapsed
+	}
+	table.Append([]string{
+		name,
+		"time-elapsed",
+		calls,
+		fmt.Sprintf("%s", n.Inclusive.Elapsed),
+		fmt.Sprintf("%s", n.Exclusive.Elapsed),
+		percent(float64(n.Inclusive.Elapsed), float64(total)),
+	})
+	for i, d := range n.Inclusive.Derived {
+		excl := math.NaN()
+		if i < len(n.Exclusive.Derived) {
+			excl = n.Exclusive.Derived[i].Value
+		}
+		table.Append([]string{
+			name,
+			d.Label,
+			calls,
+			formatDerived(d.Value),
+			formatDerived(excl),
+			"",
+		})
+	}
+
+	for _, c := range n.Children {
+		c.writeTo(table, n, depth+1)
+	}
+}
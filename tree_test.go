@@ -0,0 +1,41 @@
+package perforator
+
+import "testing"
+
+func TestTree(t *testing.T) {
+	// children end before their parents
+	total := TotalMetrics{
+		named("leaf", 10, count("instructions", 10)).on(10, 10, "main").within("main", "mid"),
+		named("mid", 30, count("instructions", 30)).on(10, 10, "main").within("main"),
+		named("leaf", 20, count("instructions", 20)).on(10, 10, "main").within("main"),
+		named("main", 100, count("instructions", 100)).on(10, 10, "main"),
+		named("main", 50, count("instructions", 50)).on(10, 11, "main"),
+	}
+
+	tree := total.Tree(GroupRegion)
+	if len(tree) != 1 || tree[0].Name != "main" || tree[0].Calls != 2 {
+		t.Fatalf("unexpected roots: %+v", tree)
+	}
+	root := tree[0]
+	if root.Inclusive.Results[0].Value != 150 || root.Exclusive.Results[0].Value != 100 {
+		t.Errorf("unexpected root metrics: %+v %+v", root.Inclusive, root.Exclusive)
+	}
+	if len(root.Children) != 2 || root.Children[0].Name != "mid" || root.Children[1].Name != "leaf" {
+		t.Fatalf("unexpected children: %+v", root.Children)
+	}
+	mid := root.Children[0]
+	if mid.Exclusive.Results[0].Value != 20 || mid.Exclusive.Elapsed != 20 {
+		t.Errorf("unexpected exclusive metrics: %+v", mid.Exclusive)
+	}
+	if len(mid.Children) != 1 || mid.Children[0].Inclusive.Results[0].Value != 10 {
+		t.Errorf("unexpected nested leaf: %+v", mid.Children)
+	}
+
+	threads := total.Tree(GroupThread)
+	if len(threads) != 2 || threads[0].Name != "main [10 main]" || threads[1].Name != "main [11 main]" {
+		t.Fatalf("unexpected thread roots: %+v", threads)
+	}
+	if len(threads[1].Children) != 0 || threads[0].Children[0].Name != "mid" {
+		t.Errorf("unexpected thread children: %+v %+v", threads[0].Children, threads[1].Children)
+	}
+}
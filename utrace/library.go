@@ -0,0 +1,283 @@
+package utrace
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A LibraryTracer finds the regions to trace in shared libraries. If the
+// PieOffsetter of a program also implements LibraryTracer, shared libraries
+// are traced as they are loaded, including those opened with dlopen.
+type LibraryTracer interface {
+	// Rendezvous returns the address in the process of the dynamic linker's
+	// rendezvous function (_dl_debug_state), which is called every time the
+	// list of loaded libraries changes. It returns 0 if libraries should not
+	// be traced, for example if the program is statically linked.
+	Rendezvous(pid int) (uint64, error)
+	// Library returns the regions to trace in the shared library at 'path',
+	// relative to the load bias of the library, and the IDs to report for
+	// them in events.
+	Library(pid int, path string) (regions []Region, ids []int, err error)
+}
+
+// A space is the state of an address space, which is shared by all threads
+// of a process. A process created with fork starts with a copy of the
+// address space of its parent.
+type space struct {
+	img       *image
+	pieOffset uint64
+	// the address of the rendezvous breakpoint, or 0
+	rendezvous uint64
+
+	// the breakpoints that have been inserted into the address space, which
+	// are shared by all of its threads
+	breakpoints map[uintptr]*breakpoint
+
+	// the libraries that are loaded, and the regions found in them
+	libs       map[object]bool
+	libRegions []libRegion
+}
+
+// A breakpoint is an interrupt inserted into an address space. It stays armed
+// as long as any thread needs it, and a thread that hits it steps over the
+// original instruction while the other threads are held, so every thread that
+// reaches it is stopped.
+type breakpoint struct {
+	orig []byte
+	// permanent breakpoints are the starts of regions and the rendezvous,
+	// which are never removed
+	permanent bool
+	// the number of activations in all threads that end at the breakpoint
+	ends int
+	// inserted is false once the original code has been written back
+	inserted bool
+}
+
+// An object is a file mapped into an address space at a load bias.
+type object struct {
+	path string
+	bias uint64
+}
+
+type libRegion struct {
+	region Region
+	lib    object
+	id     int
+}
+
+// newSpace creates the address space of a process that has just started
+// executing 'img'.
+func newSpace(img *image, pid int) (*space, error) {
+	sp := &space{
+		img:         img,
+		breakpoints: make(map[uintptr]*breakpoint),
+		libs:        make(map[object]bool),
+	}
+
+	if len(img.regions) != 0 {
+		off, err := img.pie.PieOffset(pid)
+		if err != nil {
+			return nil, err
+		}
+		sp.pieOffset = off
+		logger.Printf("%d: PIE offset is 0x%x\n", pid, off)
+	}
+
+	if img.libs != nil {
+		addr, err := img.libs.Rendezvous(pid)
+		if err != nil {
+			return nil, fmt.Errorf("rendezvous: %w", err)
+		}
+		sp.rendezvous = addr
+		logger.Printf("%d: rendezvous at 0x%x\n", pid, addr)
+	}
+	return sp, nil
+}
+
+// fork returns a copy of the address space for a child process. The child
+// has a copy of the interrupts as well, but none of the activations, so end
+// breakpoints are removed when the child hits them.
+func (sp *space) fork() *space {
+	c := &space{
+		img:         sp.img,
+		pieOffset:   sp.pieOffset,
+		rendezvous:  sp.rendezvous,
+		breakpoints: make(map[uintptr]*breakpoint),
+		libs:        make(map[object]bool),
+		libRegions:  append([]libRegion(nil), sp.libRegions...),
+	}
+	for k, bp := range sp.breakpoints {
+		c.breakpoints[k] = &breakpoint{
+			orig:      bp.orig,
+			permanent: bp.permanent,
+			inserted:  bp.inserted,
+		}
+	}
+	for k, v := range sp.libs {
+		c.libs[k] = v
+	}
+	return c
+}
+
+// mappedObjects returns the files that are mapped into the address space of
+// a process, along with their load bias (the start of the mapping of the
+// beginning of the file).
+func mappedObjects(pid int) ([]object, error) {
+	maps, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer maps.Close()
+
+	var objs []object
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(maps)
+	for scanner.Scan() {
+		// address perms offset dev inode path
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[4] == "0" || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		path := fields[5]
+		if seen[path] {
+			continue
+		}
+		off, err := strconv.ParseUint(fields[2], 16, 64)
+		if err != nil || off != 0 {
+			continue
+		}
+		start, err := strconv.ParseUint(strings.Split(fields[0], "-")[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		seen[path] = true
+		objs = append(objs, object{
+			path: path,
+			bias: start,
+		})
+	}
+	return objs, scanner.Err()
+}
+
+// loadLibraries finds the shared libraries that have been loaded since the
+// last call and inserts breakpoints for their regions, and forgets those that
+// have been unloaded.
+func (p *Proc) loadLibraries() error {
+	sp := p.space
+	objs, err := mappedObjects(p.Pid())
+	if err != nil {
+		return err
+	}
+	mapped := make(map[object]bool)
+	for _, obj := range objs {
+		mapped[obj] = true
+	}
+	for obj := range sp.libs {
+		if !mapped[obj] {
+			p.unloadLibrary(obj)
+		}
+	}
+	for _, obj := range objs {
+		if sp.libs[obj] {
+			continue
+		}
+		sp.libs[obj] = true
+
+		regions, ids, err := sp.img.libs.Library(p.Pid(), obj.path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", obj.path, err)
+		}
+		if len(regions) != 0 {
+			logger.Printf("%d: loaded %s at 0x%x (%d regions)\n", p.Pid(), obj.path, obj.bias, len(regions))
+		}
+		for i, r := range regions {
+			sp.libRegions = append(sp.libRegions, libRegion{
+				region: r,
+				lib:    obj,
+				id:     ids[i],
+			})
+		}
+	}
+	return p.sync()
+}
+
+// unloadLibrary forgets a library that has been unmapped from the address
+// space, for example with dlclose, and removes its regions from every thread.
+// The interrupts of its breakpoints went away with its code, so they are
+// inserted again if the library is loaded at the same address later. An
+// activation of a removed region can never end normally, so it ends when
+// its thread next stops, which for the thread that unloaded the library is
+// right away.
+func (p *Proc) unloadLibrary(obj object) {
+	sp := p.space
+	delete(sp.libs, obj)
+
+	var kept []libRegion
+	starts := make(map[uint64]bool)
+	// the number of regions removed before each thread's count of added ones
+	removed := make(map[*Proc]int)
+	for i, lr := range sp.libRegions {
+		if lr.lib != obj {
+			kept = append(kept, lr)
+			continue
+		}
+		starts[lr.region.Start(obj.bias)] = true
+		for _, other := range p.prog.procs {
+			if other.space == sp && i < other.nlibs {
+				removed[other]++
+			}
+		}
+	}
+	sp.libRegions = kept
+	if len(starts) != 0 {
+		logger.Printf("%d: unloaded %s at 0x%x\n", p.Pid(), obj.path, obj.bias)
+	}
+
+	for addr := range starts {
+		if bp, ok := sp.breakpoints[uintptr(addr)]; ok {
+			bp.inserted = false
+			bp.permanent = false
+		}
+	}
+	for _, other := range p.prog.procs {
+		if other.space != sp {
+			continue
+		}
+		other.nlibs -= removed[other]
+		var regions []activeRegion
+		for _, r := range other.regions {
+			if r.bias != obj.bias || !starts[r.start] {
+				regions = append(regions, r)
+				continue
+			}
+			for n := len(r.stack); n > 0; n-- {
+				if bp, ok := sp.breakpoints[uintptr(r.stack[n-1].end)]; ok {
+					bp.ends--
+				}
+				logger.Printf("%d: region %d ended by unloading %s\n", other.Pid(), r.id, obj.path)
+				other.ended = append(other.ended, Event{
+					Id:    r.id,
+					State: RegionEnd,
+					Depth: n - 1,
+				})
+			}
+		}
+		other.regions = regions
+	}
+}
+
+// sync adds the library regions that were found by other threads in the
+// address space since the last call.
+func (p *Proc) sync() error {
+	for _, lr := range p.space.libRegions[p.nlibs:] {
+		err := p.addRegion(lr.region, lr.lib.bias, lr.id)
+		if err != nil {
+			return err
+		}
+	}
+	p.nlibs = len(p.space.libRegions)
+	return nil
+}
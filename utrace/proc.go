@@ -19,12 +19,22 @@ var (
 // process or a thread (they are equivalent, except for the visible address
 // space).
 type Proc struct {
-	tracer    *ptrace.Tracer
-	regions   []activeRegion
-	pieOffset uint64
-	exited    bool
-
-	breakpoints map[uintptr][]byte
+	tracer  *ptrace.Tracer
+	prog    *Program
+	space   *space
+	regions []activeRegion
+	// the number of library regions of the address space that have been
+	// added to regions
+	nlibs int
+	// the ends of activations whose library was unloaded, which are
+	// reported the next time the process stops
+	ended  []Event
+	exited bool
+	// stopped is true while the process is in a ptrace-stop that has been
+	// reported by wait but not yet continued.
+	stopped bool
+	// sig is a signal that must be delivered when the process is resumed.
+	sig unix.Signal
 }
 
 // Starts a new process from the given information and begins tracing.
@@ -48,7 +58,11 @@ func startProc(pie PieOffsetter, target string, args []string, regions []Region)
 		unix.PTRACE_O_TRACEFORK | unix.PTRACE_O_TRACEVFORK |
 		unix.PTRACE_O_TRACEEXEC
 
-	p, err := newTracedProc(cmd.Process.Pid, pie, regions, nil)
+	sp, err := newSpace(newImage(pie, regions, nil), cmd.Process.Pid)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newTracedProc(cmd.Process.Pid, sp)
 	if err != nil {
 		return nil, err
 	}
@@ -58,13 +72,23 @@ func startProc(pie PieOffsetter, target string, args []string, regions []Region)
 	}
 
 	// Wait for the initial SIGTRAP created because we are attaching
-	// with ReAttachAndContinue to properly handle group stops.
+	// with ReAttachAndContinue to properly handle group stops. The process
+	// is seized while it is in the group stop caused by SIGSTOP, which is
+	// reported first and must be listened through until SIGCONT arrives.
 	var ws unix.WaitStatus
-	_, err = unix.Wait4(p.tracer.Pid(), &ws, 0, nil)
-	if err != nil {
-		return nil, err
-	} else if ws.StopSignal() != unix.SIGTRAP {
-		return nil, errors.New("wait: received non SIGTRAP: " + ws.StopSignal().String())
+	for {
+		_, err = unix.Wait4(p.tracer.Pid(), &ws, 0, nil)
+		if err != nil {
+			return nil, err
+		} else if ws.StopSignal() == unix.SIGTRAP {
+			break
+		} else if !statusPtraceEventStop(ws) {
+			return nil, errors.New("wait: received non SIGTRAP: " + ws.StopSignal().String())
+		}
+		err = p.tracer.Listen()
+		if err != nil {
+			return nil, err
+		}
 	}
 	err = p.cont(0, false)
 
@@ -72,75 +96,171 @@ func startProc(pie PieOffsetter, target string, args []string, regions []Region)
 }
 
 // Begins tracing an already existing process
-func newTracedProc(pid int, pie PieOffsetter, regions []Region, breaks map[uintptr][]byte) (*Proc, error) {
-	off, err := pie.PieOffset(pid)
+func newTracedProc(pid int, sp *space) (*Proc, error) {
+	p := &Proc{
+		tracer: ptrace.NewTracer(pid),
+	}
+	err := p.load(sp)
 	if err != nil {
 		return nil, err
 	}
+	return p, nil
+}
 
-	logger.Printf("%d: PIE offset is 0x%x\n", pid, off)
-
-	p := &Proc{
-		tracer:      ptrace.NewTracer(pid),
-		regions:     make([]activeRegion, 0, len(regions)),
-		pieOffset:   off,
-		breakpoints: make(map[uintptr][]byte),
-	}
-
-	for id, r := range regions {
-		addr := uintptr(r.Start(p))
-		if orig, ok := breaks[addr]; ok {
-			p.breakpoints[addr] = make([]byte, len(orig))
-			copy(p.breakpoints[addr], orig)
-		} else {
-			err := p.setBreak(r.Start(p))
-			if err != nil {
-				return nil, err
-			}
+// load inserts the breakpoints for the regions of the address space 'sp',
+// which the process is executing. Breakpoints that another process sharing
+// the address space has already inserted are not inserted again.
+func (p *Proc) load(sp *space) error {
+	first := len(sp.breakpoints) == 0
+	p.space = sp
+	p.regions = nil
+	p.nlibs = 0
+
+	img := sp.img
+	for i, r := range img.regions {
+		err := p.addRegion(r, sp.pieOffset, img.ids[i])
+		if err != nil {
+			return err
 		}
+	}
 
-		p.regions = append(p.regions, activeRegion{
-			region:       r,
-			state:        RegionStart,
-			curInterrupt: r.Start(p),
-			id:           id,
-		})
+	if sp.rendezvous == 0 {
+		return nil
 	}
+	err := p.addBreak(sp.rendezvous)
+	if err != nil {
+		return err
+	}
+	if first {
+		// libraries that are already loaded when attaching
+		return p.loadLibraries()
+	}
+	return p.sync()
+}
 
-	return p, nil
+// addRegion begins tracing a region located at the load bias 'bias'.
+func (p *Proc) addRegion(r Region, bias uint64, id int) error {
+	err := p.addBreak(r.Start(bias))
+	if err != nil {
+		return err
+	}
+	p.regions = append(p.regions, activeRegion{
+		region: r,
+		bias:   bias,
+		start:  r.Start(bias),
+		id:     id,
+	})
+	return nil
 }
 
-func (p *Proc) setBreak(pc uint64) error {
-	var err error
-	pcptr := uintptr(pc)
+// addBreak inserts a permanent breakpoint into the address space unless it
+// already exists.
+func (p *Proc) addBreak(pc uint64) error {
+	bp, err := p.setBreak(pc)
+	if err != nil {
+		return err
+	}
+	bp.permanent = true
+	return nil
+}
 
-	if _, ok := p.breakpoints[pcptr]; ok {
-		// breakpoint already exists
-		return nil
+// setBreak returns the breakpoint at 'pc', inserting the interrupt if it is
+// not already armed.
+func (p *Proc) setBreak(pc uint64) (*breakpoint, error) {
+	pcptr := uintptr(pc)
+	bp, ok := p.space.breakpoints[pcptr]
+	if ok && bp.inserted {
+		return bp, nil
+	} else if !ok {
+		bp = &breakpoint{}
 	}
 
+	// the code may have changed since the breakpoint was removed, for
+	// example if a library was loaded again at the same address
 	orig := make([]byte, len(interrupt))
-	_, err = p.tracer.PeekData(pcptr, orig)
+	_, err := p.tracer.PeekData(pcptr, orig)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	_, err = p.tracer.PokeData(pcptr, interrupt)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	p.breakpoints[pcptr] = orig
-	return nil
+	bp.orig = orig
+	bp.inserted = true
+	p.space.breakpoints[pcptr] = bp
+	return bp, nil
 }
 
 func (p *Proc) removeBreak(pc uint64) error {
-	pcptr := uintptr(pc)
-	orig, ok := p.breakpoints[pcptr]
+	bp, ok := p.space.breakpoints[uintptr(pc)]
 	if !ok {
 		return ErrInvalidBreakpoint
 	}
-	_, err := p.tracer.PokeData(pcptr, orig)
-	delete(p.breakpoints, pcptr)
+	bp.inserted = false
+	_, err := p.tracer.PokeData(uintptr(pc), bp.orig)
+	return err
+}
+
+// stepOver executes the instruction at the breakpoint 'pc' and reinserts the
+// breakpoint. The program counter must already point at the breakpoint. The
+// other threads in the address space are held while the original code is in
+// place so that none of them can run past the breakpoint.
+func (p *Proc) stepOver(pc uint64) error {
+	var held []heldProc
+	if p.prog != nil {
+		var err error
+		held, err = p.prog.hold(p)
+		if err != nil {
+			p.prog.resume(held)
+			return err
+		}
+	}
+
+	err := p.step(pc)
+	if p.prog != nil {
+		rerr := p.prog.resume(held)
+		if err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (p *Proc) step(pc uint64) error {
+	pcptr := uintptr(pc)
+	_, err := p.tracer.PokeData(pcptr, p.space.breakpoints[pcptr].orig)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = p.tracer.SingleStep()
+		if err != nil {
+			return err
+		}
+		var ws unix.WaitStatus
+		_, err = unix.Wait4(p.Pid(), &ws, unix.WALL, nil)
+		if err != nil {
+			return err
+		}
+		if ws.Exited() || ws.Signaled() {
+			p.exit()
+			return nil
+		}
+		if statusPtraceEventStop(ws) {
+			// an interrupt requested while holding threads, which arrived
+			// before the step
+			continue
+		} else if ws.StopSignal() == unix.SIGTRAP {
+			break
+		}
+		// deliver the signal once the step is done
+		p.sig = ws.StopSignal()
+	}
+
+	_, err = p.tracer.PokeData(pcptr, interrupt)
 	return err
 }
 
@@ -149,67 +269,190 @@ func (p *Proc) removeBreak(pc uint64) error {
 type Event struct {
 	Id    int
 	State RegionState
+	// Depth is the number of activations of the region that enclose this
+	// one in the same thread, which is non-zero for recursive calls.
+	Depth int
 }
 
+// handleInterrupt handles a breakpoint. The start breakpoint of every region
+// stays armed so that recursive entries and entries by other threads are
+// seen, and each entry pushes an activation whose end breakpoint is armed
+// until it is reached. Breakpoints are shared by the threads of a process, so
+// a thread may also hit the end of an activation of another thread, which it
+// steps over without any event.
 func (p *Proc) handleInterrupt() ([]Event, error) {
 	var regs unix.PtraceRegs
 	p.tracer.GetRegs(&regs)
 	regs.Rip -= uint64(len(interrupt))
 	p.tracer.SetRegs(&regs)
 
-	logger.Printf("%d: interrupt at 0x%x\n", p.Pid(), regs.Rip)
+	pc := regs.Rip
+	logger.Printf("%d: interrupt at 0x%x\n", p.Pid(), pc)
 
-	err := p.removeBreak(regs.Rip)
+	if p.space.rendezvous != 0 && pc == p.space.rendezvous {
+		// the dynamic linker has changed the list of loaded libraries
+		err := p.stepOver(pc)
+		if err != nil || p.exited {
+			return nil, err
+		}
+		return nil, p.loadLibraries()
+	}
+
+	// the breakpoint may belong to a library found by another thread
+	err := p.sync()
 	if err != nil {
 		return nil, err
 	}
+	bp, ok := p.space.breakpoints[uintptr(pc)]
+	if !ok {
+		return nil, ErrInvalidBreakpoint
+	} else if !bp.inserted {
+		// Another thread removed the breakpoint after this one hit it. The
+		// code is written back again in case this process is a fork whose
+		// copy of the interrupt was never removed.
+		_, err = p.tracer.PokeData(uintptr(pc), bp.orig)
+		return nil, err
+	}
 
 	events := make([]Event, 0)
-	for i, r := range p.regions {
-		var err error
-		if r.curInterrupt == regs.Rip {
+
+	// Exits are handled first, so that a region that ends where it starts
+	// is exited before it is entered again.
+	for i := range p.regions {
+		r := &p.regions[i]
+		for n := len(r.stack); n > 0; n-- {
+			top := r.stack[n-1]
+			if top.end != pc || (top.sp != 0 && top.sp > regs.Rsp) {
+				break
+			}
+			r.stack = r.stack[:n-1]
+			bp.ends--
 			events = append(events, Event{
 				Id:    r.id,
-				State: r.state,
+				State: RegionEnd,
+				Depth: n - 1,
 			})
-			switch r.state {
-			case RegionStart:
-				p.regions[i].state = RegionEnd
-				var addr uint64
-				addr, err = r.region.End(regs.Rsp, p)
-				if err != nil {
-					return nil, err
-				}
-				p.regions[i].curInterrupt = addr
-				err = p.setBreak(addr)
-			case RegionEnd:
-				p.regions[i].state = RegionStart
-				p.regions[i].curInterrupt = r.region.Start(p)
-				err = p.setBreak(p.regions[i].curInterrupt)
-			default:
-				return nil, errors.New("invalid state")
+			if top.sp == 0 {
+				// without a stack pointer, activations that end at the
+				// same address can't be told apart, so only end one
+				break
 			}
 		}
+	}
+
+	for i := range p.regions {
+		r := &p.regions[i]
+		if r.start != pc {
+			continue
+		}
+		end, sp, err := r.region.End(regs.Rsp, r.bias, p)
 		if err != nil {
 			return nil, err
 		}
+		events = append(events, Event{
+			Id:    r.id,
+			State: RegionStart,
+			Depth: len(r.stack),
+		})
+		r.stack = append(r.stack, activation{
+			end: end,
+			sp:  sp,
+		})
+		endbp, err := p.setBreak(end)
+		if err != nil {
+			return nil, err
+		}
+		endbp.ends++
 	}
 
-	return events, nil
+	if bp.permanent || bp.ends > 0 {
+		err = p.stepOver(pc)
+	} else {
+		err = p.removeBreak(pc)
+	}
+	return events, err
 }
 
 func (p *Proc) cont(sig unix.Signal, groupStop bool) error {
 	if p.exited {
 		return nil
 	}
+	p.stopped = false
 	if groupStop {
 		return p.tracer.Listen()
 	}
+	if sig == 0 {
+		// a signal that arrived while the process was being stepped
+		sig = p.sig
+	}
+	p.sig = 0
 	return p.tracer.Cont(sig)
 }
 
+// takeEnded returns the activations that ended since the process last
+// stopped without reaching their end (see unloadLibrary).
+func (p *Proc) takeEnded() []Event {
+	ended := p.ended
+	p.ended = nil
+	return ended
+}
+
 func (p *Proc) exit() {
+	if p.exited {
+		return
+	}
 	p.exited = true
+	if p.space == nil {
+		return
+	}
+	// the activations of the process will never end, so their breakpoints
+	// are removed when another thread hits them
+	for _, r := range p.regions {
+		for _, a := range r.stack {
+			if bp, ok := p.space.breakpoints[uintptr(a.end)]; ok {
+				bp.ends--
+			}
+		}
+	}
+}
+
+// rewind moves the program counter back over an interrupt instruction if the
+// process is stopped directly after one of the given breakpoints.
+func (p *Proc) rewind(breaks map[uintptr]bool) error {
+	var regs unix.PtraceRegs
+	err := p.tracer.GetRegs(&regs)
+	if err != nil {
+		return err
+	}
+	pc := regs.Rip - uint64(len(interrupt))
+	if !breaks[uintptr(pc)] {
+		return nil
+	}
+	logger.Printf("%d: rewinding interrupt at 0x%x\n", p.Pid(), pc)
+	regs.Rip = pc
+	return p.tracer.SetRegs(&regs)
+}
+
+// restore writes back the original code for every breakpoint in the address
+// space of this process.
+func (p *Proc) restore() error {
+	if p.space == nil {
+		return nil
+	}
+	for addr, bp := range p.space.breakpoints {
+		if !bp.inserted {
+			continue
+		}
+		_, err := p.tracer.PokeData(addr, bp.orig)
+		if err == unix.EIO {
+			// the code has been unmapped, for example because a
+			// library was closed with dlclose
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Pid returns this process's PID.
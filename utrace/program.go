@@ -1,11 +1,9 @@
 // Package utrace provides an interface for tracing user-level code with
 // ptrace. The implementation transparently places and removes software
 // breakpoints to regain control from a traced program. Multithreaded programs
-// are supported with the caveat that each region may only be executed once
-// (ever) by a certain thread. In other words, it is best to only use utrace
-// for tracing single threaded programs, but if the program is multithreaded it
-// will still work as long as only one of the threads executes the region of
-// interest.
+// are supported: the breakpoints at the start of regions stay armed, and a
+// thread that hits a breakpoint steps over it while the other threads of the
+// process are held, so every thread that enters a region is reported.
 //
 // NOTE: make sure runtime.LockOSThread() has been called before using any of
 // the following functions, and may not unlock the thread until you are
@@ -14,11 +12,23 @@ package utrace
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/zyedidia/perforator/utrace/ptrace"
 	"golang.org/x/sys/unix"
 )
 
-var ErrFinishedTrace = errors.New("tracing finished")
+var (
+	ErrFinishedTrace = errors.New("tracing finished")
+	ErrInterrupted   = errors.New("tracing interrupted")
+)
 
 // Status represents a return status from a call to Wait.
 type Status struct {
@@ -26,20 +36,167 @@ type Status struct {
 
 	sig       unix.Signal
 	groupStop bool
+	created   int
+}
+
+// Created returns the thread or process that was created, if the status is a
+// clone or fork event, and 0 otherwise. The new thread is already traced, but
+// Wait only returns it once it first stops.
+func (s Status) Created() int {
+	return s.created
 }
 
+// An ExecHandler is called when the traced process 'pid' has called execve.
+// It returns the regions to trace in the new program image, the IDs to report
+// in events for each region, and the PieOffsetter for the image. If no
+// regions are returned, the process is still traced (so that any programs it
+// executes are followed) but no breakpoints are inserted.
+type ExecHandler func(pid int) (pie PieOffsetter, regions []Region, ids []int, err error)
+
 // A Program is a collection of running processes that are being traced.
 // Threads or processes that are executing the same code as the original parent
-// will be traced, but if they ever call execve, they will no longer be traced.
+// will be traced, but if they ever call execve, they will no longer be traced
+// unless FollowExec is used.
 // The Program struct makes it simpler to support multiple threads in the child
 // since it will handle the nitty gritty of tracing each thread.
 type Program struct {
 	procs    map[int]*Proc
 	untraced map[int]*Proc
 
-	regions     []Region
-	pie         PieOffsetter
-	breakpoints map[uintptr][]byte
+	// the image of the original process
+	img  *image
+	exec ExecHandler
+
+	// statuses received while holding threads, to be returned by Wait
+	pending []pendingStatus
+
+	sigchld   chan os.Signal
+	interrupt chan struct{}
+	once      sync.Once
+}
+
+// creators names the system calls that report each ptrace event of a new
+// thread or process.
+var creators = map[int]string{
+	unix.PTRACE_EVENT_CLONE: "clone",
+	unix.PTRACE_EVENT_FORK:  "fork",
+	unix.PTRACE_EVENT_VFORK: "vfork",
+}
+
+type pendingStatus struct {
+	pid int
+	ws  unix.WaitStatus
+}
+
+// A heldProc is a thread that was stopped by hold and is continued by resume.
+type heldProc struct {
+	proc      *Proc
+	groupStop bool
+}
+
+// An image is a program along with the regions traced in it.
+type image struct {
+	pie     PieOffsetter
+	libs    LibraryTracer
+	regions []Region
+	ids     []int
+}
+
+func newImage(pie PieOffsetter, regions []Region, ids []int) *image {
+	if ids == nil {
+		ids = make([]int, len(regions))
+		for i := range ids {
+			ids[i] = i
+		}
+	}
+	libs, _ := pie.(LibraryTracer)
+	return &image{
+		pie:     pie,
+		libs:    libs,
+		regions: regions,
+		ids:     ids,
+	}
+}
+
+func newProgram(pie PieOffsetter, regions []Region) *Program {
+	prog := &Program{
+		procs:     make(map[int]*Proc),
+		untraced:  make(map[int]*Proc),
+		img:       newImage(pie, regions, nil),
+		sigchld:   make(chan os.Signal, 1),
+		interrupt: make(chan struct{}),
+	}
+	// Every ptrace-stop is also signaled with SIGCHLD, which lets Wait
+	// block on a channel that can be interrupted.
+	signal.Notify(prog.sigchld, unix.SIGCHLD)
+	return prog
+}
+
+func (p *Program) addProc(proc *Proc) {
+	proc.prog = p
+	p.procs[proc.Pid()] = proc
+}
+
+// hold stops every other running thread that shares the address space of
+// 'proc', so that a breakpoint can be lifted while 'proc' steps over it. A
+// thread that reports something else before the stop, such as a breakpoint
+// or a signal, stays stopped and its status is returned by a later call to
+// Wait.
+func (p *Program) hold(proc *Proc) ([]heldProc, error) {
+	var interrupted []*Proc
+	for _, other := range p.procs {
+		if other == proc || other.space != proc.space || other.stopped || other.exited {
+			continue
+		}
+		if other.tracer.Interrupt() == nil {
+			interrupted = append(interrupted, other)
+		}
+	}
+
+	var held []heldProc
+	for _, other := range interrupted {
+		var ws unix.WaitStatus
+		_, err := unix.Wait4(other.Pid(), &ws, unix.WALL, nil)
+		if err != nil {
+			return held, err
+		}
+		if ws.Stopped() {
+			other.stopped = true
+		}
+		if ws.Stopped() && statusPtraceEventStop(ws) {
+			// A thread in a group stop reports the stop signal instead of
+			// SIGTRAP, and must be listened to again.
+			held = append(held, heldProc{
+				proc:      other,
+				groupStop: ws.StopSignal() != unix.SIGTRAP,
+			})
+			continue
+		}
+		p.pending = append(p.pending, pendingStatus{
+			pid: other.Pid(),
+			ws:  ws,
+		})
+	}
+	return held, nil
+}
+
+// resume continues the threads stopped by hold.
+func (p *Program) resume(held []heldProc) error {
+	var err error
+	for _, h := range held {
+		cerr := h.proc.cont(0, h.groupStop)
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// FollowExec makes the program keep tracing processes after they call
+// execve. The handler determines the regions to trace in each new image. It
+// must be called before Wait.
+func (p *Program) FollowExec(h ExecHandler) {
+	p.exec = h
 }
 
 // NewProgram returns a new running program created from the given elf binary
@@ -48,24 +205,343 @@ type Program struct {
 // block until the target process or one of its threads/children begins or
 // finishes executing a region.
 func NewProgram(pie PieOffsetter, target string, args []string, regions []Region) (*Program, int, error) {
+	prog := newProgram(pie, regions)
 	proc, err := startProc(pie, target, args, regions)
 	if err != nil {
+		prog.close()
 		return nil, 0, err
 	}
+	prog.addProc(proc)
+
+	return prog, proc.Pid(), err
+}
+
+// AttachProgram begins tracing the already running process 'pid' and all of
+// its threads. Every thread is stopped while the region breakpoints are
+// inserted and then resumed. Unlike with NewProgram, the process is not
+// killed when the tracer exits, so Detach should be used to stop tracing and
+// leave the process running as it was before.
+func AttachProgram(pie PieOffsetter, pid int, regions []Region) (*Program, error) {
+	options := unix.PTRACE_O_TRACECLONE | unix.PTRACE_O_TRACEFORK |
+		unix.PTRACE_O_TRACEVFORK | unix.PTRACE_O_TRACEEXEC
+
+	prog := newProgram(pie, regions)
+
+	// Threads may be created while we are attaching, so keep scanning the
+	// task list until no new threads show up. Threads created by a thread
+	// that has already been seized are attached automatically and will be
+	// reported by Wait instead.
+	seized := make(map[int]bool)
+	var tids []int
+	for {
+		tasks, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+		if err != nil {
+			prog.release(tids)
+			return nil, err
+		}
+		found := false
+		for _, t := range tasks {
+			tid, err := strconv.Atoi(t.Name())
+			if err != nil || seized[tid] {
+				continue
+			}
+			seized[tid] = true
+			found = true
+			err = ptrace.NewTracer(tid).Seize(options)
+			if err != nil {
+				if tid == pid {
+					prog.release(tids)
+					return nil, fmt.Errorf("seize %d: %w", tid, err)
+				}
+				logger.Printf("%d: could not seize thread: %v\n", tid, err)
+				continue
+			}
+			logger.Printf("%d: seized\n", tid)
+			tids = append(tids, tid)
+		}
+		if !found {
+			break
+		}
+	}
+
+	// Stop every thread so that breakpoints can be safely inserted.
+	sigs := make(map[int]unix.Signal)
+	var stopped []int
+	for _, tid := range tids {
+		ptrace.NewTracer(tid).Interrupt()
+	}
+	for _, tid := range tids {
+		var ws unix.WaitStatus
+		_, err := unix.Wait4(tid, &ws, unix.WALL, nil)
+		if err != nil {
+			prog.release(stopped)
+			return nil, err
+		}
+		if ws.Exited() || ws.Signaled() {
+			continue
+		}
+		if ws.StopSignal() != unix.SIGTRAP && !statusPtraceEventStop(ws) {
+			// The thread stopped for a signal before the interrupt was
+			// handled, so the signal must be replayed.
+			sigs[tid] = ws.StopSignal()
+		}
+		stopped = append(stopped, tid)
+	}
+	if len(stopped) == 0 {
+		prog.close()
+		return nil, fmt.Errorf("attach %d: process exited", pid)
+	}
 
-	prog := new(Program)
-	prog.procs = map[int]*Proc{
-		proc.Pid(): proc,
+	sp, err := newSpace(prog.img, pid)
+	if err != nil {
+		prog.release(stopped)
+		return nil, err
 	}
-	prog.regions = regions
-	prog.pie = pie
-	prog.breakpoints = make(map[uintptr][]byte)
-	for k, v := range proc.breakpoints {
-		prog.breakpoints[k] = make([]byte, len(v))
-		copy(prog.breakpoints[k], v)
+	for _, tid := range stopped {
+		proc, err := newTracedProc(tid, sp)
+		if err != nil {
+			prog.Detach()
+			prog.release(stopped)
+			return nil, err
+		}
+		proc.stopped = true
+		proc.sig = sigs[tid]
+		prog.addProc(proc)
 	}
 
-	return prog, proc.Pid(), err
+	for _, proc := range prog.procs {
+		err := proc.cont(proc.sig, false)
+		if err != nil {
+			prog.Detach()
+			return nil, err
+		}
+	}
+
+	return prog, nil
+}
+
+// Threads returns the IDs of every thread and process that is traced. After
+// AttachProgram these are the threads of the process, some of which may not
+// be returned by Wait until they hit a breakpoint.
+func (p *Program) Threads() []int {
+	tids := make([]int, 0, len(p.procs))
+	for tid := range p.procs {
+		tids = append(tids, tid)
+	}
+	sort.Ints(tids)
+	return tids
+}
+
+// release detaches from the given threads without restoring any breakpoints.
+// It is used when attaching fails before any breakpoints were inserted.
+func (p *Program) release(tids []int) {
+	for _, tid := range tids {
+		ptrace.NewTracer(tid).Detach(0)
+	}
+	p.close()
+}
+
+func (p *Program) close() {
+	signal.Stop(p.sigchld)
+}
+
+// Interrupt causes the current or next call to Wait to return
+// ErrInterrupted. Unlike the other methods of Program, Interrupt may be called
+// from any goroutine.
+func (p *Program) Interrupt() {
+	p.once.Do(func() {
+		close(p.interrupt)
+	})
+}
+
+func (p *Program) interrupted() bool {
+	select {
+	case <-p.interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait4 waits for any traced process to change state. It blocks on SIGCHLD
+// rather than in the wait4 system call so that it can be interrupted.
+// Statuses received while holding threads are returned first. Only the
+// children of the tracing thread are waited for, so that several programs may
+// be traced at once from different threads.
+func (p *Program) wait4(ws *unix.WaitStatus) (int, error) {
+	for {
+		if p.interrupted() {
+			return 0, ErrInterrupted
+		}
+		if len(p.pending) != 0 {
+			st := p.pending[0]
+			p.pending = p.pending[1:]
+			*ws = st.ws
+			return st.pid, nil
+		}
+		wpid, err := unix.Wait4(-1, ws, unix.WALL|unix.WNOHANG|unix.WNOTHREAD, nil)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil || wpid != 0 {
+			return wpid, err
+		}
+		select {
+		case <-p.sigchld:
+		case <-p.interrupt:
+		}
+	}
+}
+
+// Detach removes all breakpoints and stops tracing every process in the
+// program, leaving them running. Any thread that is stopped on a breakpoint
+// is moved back to the original instruction first. Detach must be called
+// from the tracing thread, and is typically used after Wait returns
+// ErrInterrupted.
+func (p *Program) Detach() error {
+	defer p.close()
+
+	procs := make([]*Proc, 0, len(p.procs)+len(p.untraced))
+	for _, proc := range p.procs {
+		procs = append(procs, proc)
+	}
+	for _, proc := range p.untraced {
+		procs = append(procs, proc)
+	}
+
+	for _, proc := range procs {
+		if !proc.stopped {
+			proc.tracer.Interrupt()
+		}
+	}
+
+	// The breakpoints of every address space, including the ones that have
+	// been removed since a thread may have hit it before.
+	breaks := make(map[uintptr]bool)
+	for _, proc := range procs {
+		if proc.space != nil {
+			for addr := range proc.space.breakpoints {
+				breaks[addr] = true
+			}
+		}
+	}
+
+	var errs []error
+	// threads that were held report the statuses queued for them instead
+	for _, st := range p.pending {
+		proc, ok := p.procs[st.pid]
+		if !ok {
+			continue
+		}
+		children, _, err := p.settle(proc, st.ws, breaks)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		procs = append(procs, children...)
+	}
+	p.pending = nil
+
+	for i := 0; i < len(procs); i++ {
+		proc := procs[i]
+		if proc.stopped {
+			continue
+		}
+		children, err := p.waitStopped(proc, breaks)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		procs = append(procs, children...)
+	}
+
+	restored := make(map[*space]bool)
+	for _, proc := range procs {
+		if proc.exited || restored[proc.space] {
+			continue
+		}
+		restored[proc.space] = true
+		err := proc.restore()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%d: restore: %w", proc.Pid(), err))
+		}
+	}
+	for _, proc := range procs {
+		if proc.exited {
+			continue
+		}
+		err := proc.tracer.Detach(proc.sig)
+		if err != nil && err != unix.ESRCH {
+			errs = append(errs, fmt.Errorf("%d: detach: %w", proc.Pid(), err))
+		}
+		logger.Printf("%d: detached\n", proc.Pid())
+	}
+
+	p.procs = make(map[int]*Proc)
+	p.untraced = make(map[int]*Proc)
+
+	if len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// waitStopped waits for an interrupted process to stop. Any new threads or
+// processes that it creates in the meantime are returned so that they can be
+// detached as well.
+func (p *Program) waitStopped(proc *Proc, breaks map[uintptr]bool) ([]*Proc, error) {
+	var children []*Proc
+	for {
+		var ws unix.WaitStatus
+		_, err := unix.Wait4(proc.Pid(), &ws, unix.WALL, nil)
+		if err != nil {
+			proc.exit()
+			return children, err
+		}
+		c, stopped, err := p.settle(proc, ws, breaks)
+		children = append(children, c...)
+		if stopped || err != nil {
+			return children, err
+		}
+	}
+}
+
+// settle prepares a process that reported the status 'ws' to be detached. It
+// returns the new thread or process that was created if the status is a
+// clone or fork event, and false if the process is still running.
+func (p *Program) settle(proc *Proc, ws unix.WaitStatus, breaks map[uintptr]bool) ([]*Proc, bool, error) {
+	if ws.Exited() || ws.Signaled() {
+		proc.exit()
+		return nil, true, nil
+	} else if !ws.Stopped() {
+		return nil, false, nil
+	}
+
+	proc.stopped = true
+	if ws.StopSignal() != unix.SIGTRAP {
+		if !statusPtraceEventStop(ws) {
+			proc.sig = ws.StopSignal()
+		}
+		return nil, true, nil
+	}
+
+	var children []*Proc
+	var err error
+	switch ws.TrapCause() {
+	case unix.PTRACE_EVENT_CLONE, unix.PTRACE_EVENT_FORK, unix.PTRACE_EVENT_VFORK:
+		// The new child starts out traced, and a forked child also has a
+		// copy of our breakpoints that must be removed.
+		newpid, err := proc.tracer.GetEventMsg()
+		if err == nil {
+			child := &Proc{
+				tracer: ptrace.NewTracer(int(newpid)),
+			}
+			if proc.space != nil {
+				child.space = proc.space.fork()
+			}
+			children = append(children, child)
+		}
+	case 0:
+		err = proc.rewind(breaks)
+	}
+	return children, true, err
 }
 
 // Wait blocks until a thread/child process enters or exits a region. The wait
@@ -76,34 +552,34 @@ func NewProgram(pie PieOffsetter, target string, args []string, regions []Region
 func (p *Program) Wait(status *Status) (*Proc, []Event, error) {
 	ws := &status.WaitStatus
 
-	wpid, err := unix.Wait4(-1, ws, 0, nil)
+	wpid, err := p.wait4(ws)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	status.sig = 0
 	status.groupStop = false
+	status.created = 0
 	untraced := false
 	proc, ok := p.procs[wpid]
 	if !ok {
 		proc, untraced = p.untraced[wpid]
 		if !untraced {
-			proc, err = newTracedProc(wpid, p.pie, p.regions, p.breakpoints)
-			if err != nil {
-				return nil, nil, err
-			}
-			p.procs[wpid] = proc
-			logger.Printf("%d: new process created (tracing enabled)\n", wpid)
-			return proc, nil, nil
+			return p.newProc(wpid, ws)
 		}
 	}
 
+	if ws.Stopped() {
+		proc.stopped = true
+	}
+
 	if ws.Exited() || ws.Signaled() {
 		logger.Printf("%d: exited\n", wpid)
 		delete(p.procs, wpid)
 		proc.exit()
 
 		if len(p.procs) == 0 {
+			p.close()
 			return proc, nil, ErrFinishedTrace
 		}
 	} else if !ws.Stopped() {
@@ -116,27 +592,139 @@ func (p *Program) Wait(status *Status) (*Proc, []Event, error) {
 			logger.Printf("%d: received signal '%s'\n", wpid, ws.StopSignal())
 			status.sig = ws.StopSignal()
 		}
-	} else if ws.TrapCause() == unix.PTRACE_EVENT_CLONE {
+	} else if ws.TrapCause() == unix.PTRACE_EVENT_STOP {
+		// a stop requested with PTRACE_INTERRUPT that arrived late
+		logger.Printf("%d: interrupted\n", wpid)
+	} else if cause := ws.TrapCause(); cause == unix.PTRACE_EVENT_CLONE || cause == unix.PTRACE_EVENT_FORK || cause == unix.PTRACE_EVENT_VFORK {
 		newpid, err := proc.tracer.GetEventMsg()
-		logger.Printf("%d: called clone() = %d (err=%v)\n", wpid, newpid, err)
-	} else if ws.TrapCause() == unix.PTRACE_EVENT_FORK {
-		logger.Printf("%d: called fork()\n", wpid)
-	} else if ws.TrapCause() == unix.PTRACE_EVENT_VFORK {
-		logger.Printf("%d: called vfork()\n", wpid)
+		logger.Printf("%d: called %s() = %d (err=%v)\n", wpid, creators[cause], newpid, err)
+		if err == nil {
+			status.created = int(newpid)
+		}
 	} else if ws.TrapCause() == unix.PTRACE_EVENT_EXEC {
-		logger.Printf("%d: called exec() (tracing disabled)\n", wpid)
-		delete(p.procs, wpid)
-		p.untraced[wpid] = proc
+		// If a thread other than the thread group leader calls execve, it
+		// takes over the pid of the leader, so its old pid must be dropped.
+		former, err := proc.tracer.GetEventMsg()
+		if err == nil && int(former) != wpid {
+			delete(p.procs, int(former))
+			delete(p.untraced, int(former))
+		}
+		// the old address space and its breakpoints no longer exist
+		proc.space = nil
+		proc.regions = nil
+		if p.exec == nil || untraced {
+			logger.Printf("%d: called exec() (tracing disabled)\n", wpid)
+			delete(p.procs, wpid)
+			p.untraced[wpid] = proc
+			return proc, nil, nil
+		}
+		logger.Printf("%d: called exec() (following)\n", wpid)
+		pie, regions, ids, err := p.exec(wpid)
+		if err != nil {
+			return nil, nil, fmt.Errorf("exec: %w", err)
+		}
+		sp, err := newSpace(newImage(pie, regions, ids), wpid)
+		if err != nil {
+			return nil, nil, fmt.Errorf("exec: %w", err)
+		}
+		err = proc.load(sp)
+		if err != nil {
+			return nil, nil, fmt.Errorf("exec: %w", err)
+		}
 	} else if !untraced {
 		events, err := proc.handleInterrupt()
 		if err != nil {
 			return nil, nil, err
 		}
-		return proc, events, nil
+		if proc.exited {
+			// killed while stepping over a breakpoint
+			logger.Printf("%d: exited\n", wpid)
+			delete(p.procs, wpid)
+			if len(p.procs) == 0 {
+				p.close()
+				return proc, nil, ErrFinishedTrace
+			}
+		}
+		return proc, append(proc.takeEnded(), events...), nil
 	}
+	return proc, proc.takeEnded(), nil
+}
+
+// newProc starts tracing a new thread or process. A thread shares the address
+// space of the process that created it, and a process created with fork
+// starts with a copy of its parent's. Children of untraced processes are not
+// traced either.
+func (p *Program) newProc(pid int, ws *unix.WaitStatus) (*Proc, []Event, error) {
+	var sp *space
+	parent, thread := p.parent(pid)
+	switch {
+	case parent == nil:
+		var err error
+		sp, err = newSpace(p.img, pid)
+		if err != nil {
+			return nil, nil, err
+		}
+	case parent.space == nil:
+	case thread:
+		sp = parent.space
+	default:
+		sp = parent.space.fork()
+	}
+
+	if sp == nil {
+		proc := &Proc{
+			tracer:  ptrace.NewTracer(pid),
+			prog:    p,
+			stopped: ws.Stopped(),
+		}
+		p.untraced[pid] = proc
+		logger.Printf("%d: new process created (tracing disabled)\n", pid)
+		return proc, nil, nil
+	}
+
+	proc, err := newTracedProc(pid, sp)
+	if err != nil {
+		return nil, nil, err
+	}
+	proc.stopped = ws.Stopped()
+	p.addProc(proc)
+	logger.Printf("%d: new process created (tracing enabled)\n", pid)
 	return proc, nil, nil
 }
 
+// parent returns the process that created the thread or process 'pid', or nil
+// if it is unknown, and whether 'pid' is a thread. For a thread this is the
+// thread group leader, and for a process it is the parent process.
+func (p *Program) parent(pid int) (*Proc, bool) {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, false
+	}
+	var tgid, ppid int
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "Tgid:":
+			tgid, _ = strconv.Atoi(fields[1])
+		case "PPid:":
+			ppid, _ = strconv.Atoi(fields[1])
+		}
+	}
+
+	thread := tgid != pid
+	id := ppid
+	if thread {
+		id = tgid
+	}
+	if proc, ok := p.procs[id]; ok {
+		return proc, thread
+	}
+	return p.untraced[id], thread
+}
+
 // Continue resumes execution of the given process. The wait status must be
 // passed to replay any signals that were received while waiting.
 func (p *Program) Continue(pr *Proc, status Status) error {
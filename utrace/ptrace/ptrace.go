@@ -24,6 +24,11 @@ func NewTracer(pid int) *Tracer {
 func (t *Tracer) ReAttachAndContinue(options int) error {
 	unix.Kill(t.pid, unix.SIGSTOP)
 	unix.PtraceDetach(t.pid)
+	// Wait for the SIGSTOP to take effect, otherwise it may be delivered
+	// after seizing and be reported instead of the expected SIGTRAP. This
+	// only works if the caller is the parent of the process.
+	var ws unix.WaitStatus
+	unix.Wait4(t.pid, &ws, unix.WUNTRACED, nil)
 	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SEIZE, uintptr(t.pid), 0, uintptr(options), 0, 0)
 	unix.Kill(t.pid, unix.SIGCONT)
 	if err == 0 {
@@ -32,6 +37,33 @@ func (t *Tracer) ReAttachAndContinue(options int) error {
 	return error(err)
 }
 
+// Seize attaches to a running process with PTRACE_SEIZE. Unlike
+// PTRACE_ATTACH, the process is not stopped and may later be stopped with
+// Interrupt.
+func (t *Tracer) Seize(options int) error {
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SEIZE, uintptr(t.pid), 0, uintptr(options), 0, 0)
+	if err == 0 {
+		return nil
+	}
+	return error(err)
+}
+
+// Interrupt stops a seized process. The stop is reported to the tracer as a
+// PTRACE_EVENT_STOP.
+func (t *Tracer) Interrupt() error {
+	return unix.PtraceInterrupt(t.pid)
+}
+
+// Detach stops tracing the process and resumes it, delivering the signal
+// 'sig' if it is non-zero.
+func (t *Tracer) Detach(sig unix.Signal) error {
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_DETACH, uintptr(t.pid), 0, uintptr(sig), 0, 0)
+	if err == 0 {
+		return nil
+	}
+	return error(err)
+}
+
 // SetOptions changes the ptrace options.
 func (t *Tracer) SetOptions(options int) error {
 	return unix.PtraceSetOptions(t.pid, options)
@@ -53,6 +85,11 @@ func (t *Tracer) Syscall(sig unix.Signal) error {
 	return err
 }
 
+// SingleStep resumes the process for a single instruction.
+func (t *Tracer) SingleStep() error {
+	return unix.PtraceSingleStep(t.pid)
+}
+
 // Listen should be used to continue execution when a group stop occurs.
 func (t *Tracer) Listen() error {
 	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_LISTEN, uintptr(t.pid), 0, 0, 0, 0)
@@ -4,10 +4,15 @@ import (
 	"encoding/binary"
 )
 
-// A Region defines a start and an end address.
+// A Region defines a start and an end address. Addresses are relative to the
+// load bias of the object that contains the region, which is the PIE offset
+// for the executable or the load address of a shared library. When the start
+// is reached with the stack pointer 'sp', End returns the address where this
+// activation of the region ends, along with the stack pointer that the
+// process will have there, or 0 if it is not known.
 type Region interface {
-	Start(p *Proc) uint64
-	End(sp uint64, p *Proc) (uint64, error)
+	Start(bias uint64) uint64
+	End(sp uint64, bias uint64, p *Proc) (addr uint64, endSp uint64, err error)
 }
 
 // An AddressRegion is the simplest possible region that directly stores the
@@ -18,13 +23,13 @@ type AddressRegion struct {
 }
 
 // Start returns this region's start address.
-func (a *AddressRegion) Start(p *Proc) uint64 {
-	return a.StartAddr + p.pieOffset
+func (a *AddressRegion) Start(bias uint64) uint64 {
+	return a.StartAddr + bias
 }
 
 // End returns this region's end address.
-func (a *AddressRegion) End(sp uint64, p *Proc) (uint64, error) {
-	return a.EndAddr + p.pieOffset, nil
+func (a *AddressRegion) End(sp uint64, bias uint64, p *Proc) (uint64, uint64, error) {
+	return a.EndAddr + bias, 0, nil
 }
 
 // A FuncRegion refers to a function, where the region begins at the start of
@@ -34,23 +39,23 @@ type FuncRegion struct {
 }
 
 // Start returns this region's start address.
-func (f *FuncRegion) Start(p *Proc) uint64 {
-	return f.Addr + p.pieOffset
+func (f *FuncRegion) Start(bias uint64) uint64 {
+	return f.Addr + bias
 }
 
 // End calculates the return address of this function given the current stack
 // frame. It is assumed that a call instruction has just been executed, so the
-// return address is at the top of the stack.
-func (f *FuncRegion) End(sp uint64, p *Proc) (uint64, error) {
+// return address is at the top of the stack, and is popped by the return.
+func (f *FuncRegion) End(sp uint64, bias uint64, p *Proc) (uint64, uint64, error) {
 	b := make([]byte, 8)
 	// read the return address from the top of the stack
 	_, err := p.tracer.ReadVM(uintptr(sp), b)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	retaddr := binary.LittleEndian.Uint64(b)
-	return retaddr, nil
+	return retaddr, sp + 8, nil
 }
 
 // A RegionState represents the current state of the region.
@@ -66,9 +71,19 @@ const (
 )
 
 type activeRegion struct {
-	region       Region
-	state        RegionState
-	curInterrupt uint64
+	region Region
+	bias   uint64
+	start  uint64
+	// the activations of the region that have not ended yet, innermost last
+	stack []activation
 
 	id int
 }
+
+// An activation is an entry into a region, which ends when the process
+// reaches 'end' with the stack pointer 'sp' (or any stack pointer if 'sp' is
+// 0).
+type activation struct {
+	end uint64
+	sp  uint64
+}